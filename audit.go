@@ -0,0 +1,98 @@
+package bufit
+
+import (
+	"io"
+	"sync"
+)
+
+// MaxAuditChunks is the # of written chunks an Audit may queue before it drops data.
+const MaxAuditChunks = 64
+
+// auditChunk is a copy of written bytes, following gap dropped bytes.
+type auditChunk struct {
+	data []byte
+	gap  int
+}
+
+type auditor struct {
+	ch   chan auditChunk
+	gap  int // bytes dropped since the last queued chunk
+	done chan struct{}
+}
+
+// Audit copies every byte written to the buffer from now on to w, without a reader: it never holds
+// data in the buffer or blocks writes. Writes are queued for w by another goroutine, if w falls more than
+// MaxAuditChunks writes behind the bytes which don't fit are dropped, and onDrop (if not nil) is called with
+// the # of bytes dropped before the bytes written after them are, so w only ever gets written bytes.
+// If writing to w fails it's detached, and nothing more is written to it. The returned stop detaches w,
+// waits until everything queued has been written to it, and returns the first error writing to w.
+func (b *Buffer) Audit(w io.Writer, onDrop func(n int)) (stop func() error) {
+	a := &auditor{ch: make(chan auditChunk, MaxAuditChunks), done: make(chan struct{})}
+	report := func(gap int) {
+		if gap > 0 && onDrop != nil {
+			b.call(func() { onDrop(gap) })
+		}
+	}
+
+	var werr error
+	go func() {
+		defer close(a.done)
+		for c := range a.ch {
+			if werr != nil {
+				continue // drain what was queued before w was detached
+			}
+			report(c.gap)
+			if _, werr = writeFull(w, c.data); werr != nil {
+				b.mu.Lock()
+				b.detach(a)
+				b.mu.Unlock()
+			}
+		}
+	}()
+
+	b.mu.Lock()
+	b.auditors = append(b.auditors, a)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			b.mu.Lock()
+			b.detach(a)
+			gap := a.gap
+			b.mu.Unlock()
+
+			close(a.ch)
+			<-a.done
+			if werr == nil {
+				report(gap)
+			}
+		})
+		return werr
+	}
+}
+
+// detach stops queueing writes for a, b.mu must be held.
+func (b *Buffer) detach(a *auditor) {
+	for i, o := range b.auditors {
+		if o == a {
+			b.auditors = append(b.auditors[:i:i], b.auditors[i+1:]...)
+			return
+		}
+	}
+}
+
+// audit queues a copy of p for every Audit, b.mu must be held.
+func (b *Buffer) audit(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	for _, a := range b.auditors {
+		select {
+		case a.ch <- auditChunk{data: append([]byte(nil), p...), gap: a.gap}:
+			a.gap = 0
+		default:
+			a.gap += len(p)
+		}
+	}
+}
@@ -2,11 +2,65 @@ package bufit
 
 import (
 	"container/heap"
+	"context"
+	"errors"
+	"hash"
 	"io"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+var (
+	// ErrNotSupported is returned when the underlying Writer doesn't support an operation.
+	ErrNotSupported = errors.New("bufit: operation not supported by Writer")
+
+	// ErrTruncateRead is returned by Truncate when some of the requested bytes have already been read.
+	ErrTruncateRead = errors.New("bufit: cannot truncate bytes which have been read")
+
+	// ErrWriteTooLarge is returned by Write when only complete writes are visible and the write is larger than the cap.
+	ErrWriteTooLarge = errors.New("bufit: write is larger than the buffer's cap")
+
+	// ErrWriteTimeout is returned by WriteDeadline, or a Write after SetWriteDeadline, when the deadline passed
+	// before all of p was written. Like ErrReadTimeout, os.IsTimeout reports it.
+	ErrWriteTimeout error = timeoutError("bufit: write deadline exceeded")
+
+	// ErrReadCanceled is returned by ReadWithCancel when it's canceled before any data is read.
+	ErrReadCanceled = errors.New("bufit: read canceled")
+
+	// ErrTooManyReaders is returned by NextReaderChecked (and the other methods which check) when the buffer
+	// already has its max readers, see SetMaxReaders.
+	ErrTooManyReaders = errors.New("bufit: too many readers")
+
+	// ErrDropped is returned once by a reader's next Read (or other read method, ex. WriteTo) after the buffer
+	// dropped data it hadn't read to make room for a write, see DropSlowestReader. BufferReader.Dropped reports
+	// how many bytes it skipped.
+	ErrDropped = errors.New("bufit: reader dropped unread data")
+
+	// ErrSlowReader is returned by Read (and the reader's other read methods, ex. WriteTo) after the reader was
+	// closed to make room for a write, see CloseSlowestReader.
+	ErrSlowReader = errors.New("bufit: reader closed for falling behind")
+
+	// ErrSeekRange is returned by BufferReader.Seek when the target is no longer (or not yet) in the buffer.
+	ErrSeekRange = errors.New("bufit: seek outside of the buffered data")
+	errWhence    = errors.New("bufit: invalid whence")
+
+	// ErrActiveReaders is returned by Reset when the buffer still has open readers.
+	ErrActiveReaders = errors.New("bufit: buffer has active readers")
+
+	// ErrReadTimeout is returned by a Read which blocked for longer than the reader's read timeout, see
+	// BufferReader.SetReadTimeout. It has a Timeout method which reports true, so os.IsTimeout reports it.
+	ErrReadTimeout error = timeoutError("bufit: read timeout")
+)
+
+// timeoutError is an error which reports being a timeout like net.Error.
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
 // Reader provides an io.Reader whose methods MUST be concurrent-safe
 // with the Write method of the Writer from which it was generated.
 // It also MUST be safe for concurrent calls to Writer.Discard
@@ -50,11 +104,19 @@ type Writer interface {
 	io.Writer
 }
 
+// Flushable is implemented by durable Writers which can commit written bytes to stable storage.
+type Flushable interface {
+
+	// Sync commits the written bytes to stable storage.
+	Sync() error
+}
+
 // Buffer is used to provide multiple readers with access to a shared buffer.
 // Readers may join/leave at any time, however a joining reader will only
 // see whats currently in the buffer onwards. Data is evicted from the buffer
 // once all active readers have read that section.
 type Buffer struct {
+	wseq  int64 // first for 64-bit alignment of atomic ops, counts writes for spinning readers
 	mu    sync.Mutex
 	rwait *sync.Cond
 	wwait *sync.Cond
@@ -64,15 +126,93 @@ type Buffer struct {
 	cap   int
 	keep  int
 	life
-	callback atomic.Value
+	err            error
+	done           chan struct{}
+	initial        int
+	initialTimeout time.Duration
+	expect         int
+	opened, peak   int
+	maxReaders     int
+	lastGone       bool
+	lastClosed     chan struct{}
+	started        bool
+	messages       bool
+	writeReaders   int
+	aligned        bool
+	ends           []boundary
+	msgTok, writes uint64
+	msgID          int
+	throttles      map[throttleKey]*throttle
+	auditors       []*auditor
+	uncapAfter     time.Duration
+	onUncap        func()
+	uncapped       bool
+	soft           int
+	retain         time.Duration
+	retaining      bool
+	resets         int // generation of the buffer's content, bumped by Reset
+	sink           io.Writer
+	draining       bool // the data from drainOff on is being written to sink, and mustn't be evicted
+	drainOff       int
+	maxLag         int
+	fullBehavior   BufferFullBehavior
+	maxAge         time.Duration
+	ageGen         int
+	paused         bool
+	pressure       func() bool
+	wsum           hash.Hash64
+	pauseFails     bool
+	record         int
+	nonblock       bool
+	readTimeout    time.Duration
+	writeDeadline  time.Time
+	spin           int
+	complete       bool
+	inflight       int
+	visible        int
+	now            func() time.Time
+	wrate, rrate   rate
+	callback       atomic.Value
+	hook           atomic.Value
+	gate           atomic.Value
+	panicHandler   atomic.Value
+	evmu           sync.Mutex
+	events         []Event
+	discardHook    atomic.Value
+	discarded      [][]byte
+	delivering     bool
+
+	amu       sync.Mutex
+	asyncSem  chan struct{}
+	asyncTail chan struct{}
 }
 
+// MaxAsyncWrites is the # of writes WriteAsync will queue before it blocks.
+const MaxAsyncWrites = 64
+
 type life struct {
 	state int32
 }
 
 func (l *life) alive() bool { return atomic.LoadInt32(&l.state) == 0 }
 func (l *life) kill()       { atomic.AddInt32(&l.state, 1) }
+func (l *life) revive()     { atomic.StoreInt32(&l.state, 0) }
+
+// eof returns the error readers return once they have read everything in a closed buffer.
+func (b *Buffer) eof() error {
+	if !b.alive() && b.err != nil {
+		return b.err
+	}
+	return io.EOF
+}
+
+// closed returns the error writes return once the buffer is closed.
+func (b *Buffer) closed() error {
+	if !b.alive() && b.err != nil {
+		return b.err
+	}
+	return io.ErrClosedPipe
+}
 
 // Keep sets the minimum amount of bytes to keep in the buffer even if all
 // other current readers have read those bytes. This allows new readers
@@ -91,36 +231,300 @@ func (b *Buffer) Keep(keep int) {
 	}
 }
 
-func (b *Buffer) fetch(r *reader) {
+// NonBlockingReads makes readers created after it's called return 0, nil from Read instead of blocking
+// while the buffer is open and has no new data. Readers can opt back into blocking with SetBlocking(true).
+func (b *Buffer) NonBlockingReads() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nonblock = true
+}
+
+// DefaultReadTimeout gives every reader created after it's called a read timeout of d, so a Read which
+// blocks for longer than d without data returns ErrReadTimeout. Readers can override it with
+// BufferReader.SetReadTimeout. A d <= 0 disables it.
+func (b *Buffer) DefaultReadTimeout(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readTimeout = d
+}
+
+// SetWriteDeadline sets the time after which Write, WriteString, WriteReport, WriteFrom and ReadFrom stop waiting
+// for room under the cap (or a ThrottleProducer, a paused buffer or initial readers) like WriteDeadline, returning
+// the # of bytes accepted and ErrWriteTimeout. Since ErrWriteTimeout is a timeout, callers can tell it apart from
+// the buffer being closed and retry the rest later. It applies to writes started after it's set, a zero t removes the deadline.
+func (b *Buffer) SetWriteDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writeDeadline = t
+}
+
+// Prefault allocates and touches a backing array of size bytes up front, so writes don't pause to grow
+// the buffer (and copy its contents) until it holds more than size bytes. Writes past size still grow it
+// unless the buffer is capped at or below size. It only applies to Writers returned by NewMemoryWriter.
+func (b *Buffer) Prefault(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w, ok := b.buf.(*writer)
+	if !ok || w.Cap() >= size {
+		return
+	}
+	w = w.realloc(size)
+	for i := w.Len(); i < len(w.data); i += 4096 { // touch every page after the copied data
+		w.data[i] = 0
+	}
+	b.buf = w
+}
+
+// WaitForInitialReaders makes the first Write block until n readers have joined the buffer,
+// or until timeout has passed (a timeout <= 0 waits until the readers join or the buffer is closed).
+// It's a one-time barrier so opening bytes aren't written before the first readers exist, once the
+// first Write has passed later writes proceed regardless of the # of readers.
+// It has no effect if called after the first Write.
+func (b *Buffer) WaitForInitialReaders(n int, timeout time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.initial = n
+	b.initialTimeout = timeout
+}
+
+// ExpectReaders makes the buffer keep everything it holds until k more readers have joined, as if
+// k readers were waiting at the front of the buffer. Unlike WaitForInitialReaders writes aren't blocked
+// (unless the buffer fills its cap), so the opening bytes can be written before the readers connect
+// and every one of them still reads them. Buffer.Discard drops nothing while readers are expected.
+func (b *Buffer) ExpectReaders(k int) {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expect = k
+	b.shift()
+}
+
+// waitForInitialReaders blocks the first write until the initial readers have joined, their timeout passed,
+// the buffer is closed, or ctx is done. It returns ctx.Err() if it stopped waiting because ctx is done.
+// b.mu must be held.
+func (b *Buffer) waitForInitialReaders(ctx context.Context) error {
+	if len(b.rh) >= b.initial {
+		return nil
+	}
+	if ctx.Done() != nil {
+		defer b.wakeOnDone(ctx)()
+	}
+
+	expired := false
+	if b.initialTimeout > 0 {
+		t := time.AfterFunc(b.initialTimeout, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			expired = true
+			b.wwait.Broadcast()
+		})
+		defer t.Stop()
+	}
+
+	for len(b.rh) < b.initial && !expired && b.alive() && ctx.Err() == nil {
+		b.wwait.Wait()
+	}
+	if ctx.Err() != nil && len(b.rh) < b.initial && !expired && b.alive() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// join adds r to the active readers. If checked is true the reader gate and max readers are consulted first,
+// and r isn't added if they refuse it. b.mu must be held.
+func (b *Buffer) join(r *BufferReader, checked bool) error {
+	if checked {
+		if err := b.admit(); err != nil {
+			return err
+		}
+		if b.maxReaders > 0 && len(b.rh) >= b.maxReaders {
+			return ErrTooManyReaders
+		}
+	}
+	b.enroll(r, false)
+	b.wwait.Broadcast() // writers may be waiting for readers to join
+	return nil
+}
+
+// enroll applies the buffer's reader settings to r and adds it to the active readers. If bulk is true r is
+// only appended to the heap, the caller must heap.Init it once it's done adding readers. b.mu must be held.
+func (b *Buffer) enroll(r *BufferReader, bulk bool) {
+	if b.expect > 0 {
+		b.expect--
+	}
+	r.record = b.record
+	r.nonblock = b.nonblock
+	r.timeout = b.readTimeout
+	r.start = r.off
+	r.settle()
+	r.touch()
+	b.track(r)
+	if bulk {
+		b.rh.Push(r)
+	} else {
+		heap.Push(&b.rh, r)
+	}
+	b.counted()
+	b.emit(Event{Kind: ReaderJoined, Readers: len(b.rh)})
+}
+
+// fetch advances r past its current snapshot and grabs a new one, if block is true
+// it waits until there is new data to snapshot or the buffer/reader is closed.
+func (b *Buffer) fetch(r *BufferReader, block bool) {
+	defer b.flush()
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	if r.alive() {
 		r.off += r.size
 		r.size = 0
-		heap.Fix(&b.rh, r.i)
+		if len(b.rh) > 1 { // a single reader is always the peek
+			heap.Fix(&b.rh, r.i)
+		}
 		b.shift()
+		b.unthrottle()
 	}
 
-	for r.off == b.off+b.buf.Len() && b.alive() && r.alive() {
+	r.waiting = true
+	if block && b.spin > 0 && r.off == b.end() {
+		b.spinFor(r)
+	}
+	for block && r.off == b.end() && b.alive() && r.alive() && !r.interrupted() {
 		b.rwait.Wait()
 	}
+	r.waiting = false
+	r.touch()
 
 	if !r.alive() {
 		return
 	}
 
-	r.data = b.buf.NextReader()
+	r.data = b.snapshot(r.data)
 	r.data.Discard(r.off - b.off)
+	if n := b.end() - r.off; r.ahead > 0 && n > r.ahead {
+		r.data = limit(r.data, r.ahead)
+	} else {
+		r.data = limit(r.data, n)
+	}
 	r.size = r.data.Len()
+	r.settle()
+}
+
+// ReadSpin makes blocking reads spin for up to iterations checks for a new write before parking the
+// goroutine, which lowers the latency of reads when the writer is about to write. Spinning burns a CPU
+// for its duration, and doesn't help if there are fewer free CPUs than spinning readers and writers.
+// An iterations <= 0 disables spinning.
+func (b *Buffer) ReadSpin(iterations int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spin = iterations
+}
+
+// spinFor releases b.mu and spins until there's a new write, the buffer or r is closed, or it has
+// checked b.spin times. b.mu must be held, and is held again when it returns.
+func (b *Buffer) spinFor(r *BufferReader) {
+	seq, spin := atomic.LoadInt64(&b.wseq), b.spin
+	b.mu.Unlock()
+	defer b.mu.Lock()
+	for i := 0; i < spin && atomic.LoadInt64(&b.wseq) == seq && b.alive() && r.alive(); i++ {
+		if i%64 == 63 {
+			runtime.Gosched() // let the writer run if it shares our P
+		}
+	}
+}
+
+// wake tells readers there may be new data.
+func (b *Buffer) wake() {
+	atomic.AddInt64(&b.wseq, 1)
+	b.rwait.Broadcast()
+}
+
+// CompleteWritesOnly makes readers only see data once the Write which wrote it has completed, so they
+// never read part of a Write which is blocked on the cap. This delays reads of large writes until they're
+// fully written, and writes larger than the cap fail with ErrWriteTooLarge since they could never complete.
+// Concurrent writes are serialized, so the bytes of each write are contiguous and it can always complete.
+func (b *Buffer) CompleteWritesOnly() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.complete = true
+}
+
+// end returns the absolute offset of the end of the data visible to readers. b.mu must be held.
+func (b *Buffer) end() int {
+	end := b.off + b.buf.Len()
+	if b.complete && b.inflight > 0 && b.visible < end {
+		return b.visible
+	}
+	return end
 }
 
-func (b *Buffer) drop(r *reader) {
+// limit returns data limited to its first n bytes.
+func limit(data Reader, n int) Reader {
+	if extra := data.Len() - n; extra > 0 {
+		if t, ok := data.(interface{ Truncate(int) (int, error) }); ok {
+			t.Truncate(extra)
+			return data
+		}
+		return &limitedSnapshot{Reader: data, n: n}
+	}
+	return data
+}
+
+type limitedSnapshot struct {
+	Reader
+	n int
+}
+
+func (l *limitedSnapshot) Len() int { return l.n }
+
+func (l *limitedSnapshot) Discard(s int) (n int, err error) {
+	if s > l.n {
+		s = l.n
+	}
+	n, err = l.Reader.Discard(s)
+	if l.n -= n; l.n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (l *limitedSnapshot) Read(p []byte) (n int, err error) {
+	if l.n == 0 {
+		return 0, io.EOF
+	} else if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err = l.Reader.Read(p)
+	if l.n -= n; l.n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// snapshot returns b.buf.NextReader(), reusing prev when both are memory writers to save an allocation.
+func (b *Buffer) snapshot(prev Reader) Reader {
+	if w, ok := b.buf.(*writer); ok {
+		if data, ok := prev.(*writer); ok {
+			*data = *w
+			return data
+		}
+	}
+	return b.buf.NextReader()
+}
+
+func (b *Buffer) drop(r *BufferReader) {
+	defer b.flush()
 	b.mu.Lock()
 
 	if len(b.rh) == 1 { // this is the last reader
 		if call := b.callback.Load(); call != nil { // callback is registered
-			defer call.(func() error)() // run this after we've unlocked
+			defer b.call(func() { call.(func() error)() }) // run this after we've unlocked
+		}
+		if !b.lastGone {
+			b.lastGone = true
+			if b.lastClosed != nil {
+				close(b.lastClosed)
+			}
 		}
 	}
 
@@ -128,12 +532,15 @@ func (b *Buffer) drop(r *reader) {
 	defer b.mu.Unlock()
 	b.shift() // remove bytes read if this was the peek
 	heap.Remove(&b.rh, r.i)
+	b.unthrottleReader(r)
+	b.emit(Event{Kind: ReaderLeft, Readers: len(b.rh)})
 	b.shift() // shift to next peek
+	b.unthrottle()
 }
 
 func (b *Buffer) shift() {
 	l := b.buf.Len()
-	if l == 0 || l <= b.keep || b.rh.Len() == 0 {
+	if l == 0 || l <= b.keep || b.rh.Len() == 0 || b.expect > 0 || b.retaining {
 		return
 	}
 
@@ -141,12 +548,53 @@ func (b *Buffer) shift() {
 		if l < b.keep+diff {
 			diff = l - b.keep
 		}
-		b.buf.Discard(diff)
-		b.off += diff
-		b.wwait.Broadcast()
+		if b.aligned && (!b.capped() || l < b.cap) { // a full buffer evicts unaligned so writes can finish
+			diff = b.alignedEnd(b.off+diff) - b.off
+		}
+		if diff > 0 {
+			b.evict(diff)
+		}
 	}
 }
 
+// evict discards the next n bytes from the buffer, they must have been read by all readers.
+// Bytes still being drained to the DrainOnCloseTo sink aren't discarded.
+func (b *Buffer) evict(n int) (int, error) {
+	if b.draining && b.off+n > b.drainOff {
+		n = b.drainOff - b.off
+	}
+	b.beforeDiscard(n)
+	n, err := b.buf.Discard(n)
+	b.off += n
+	b.rrate.add(b.now(), n)
+	if b.uncapped && b.buf.Len() < b.cap { // readers caught up, enforce the cap again
+		b.uncapped = false
+	}
+	b.evictMessages()
+	b.shrink()
+	b.emit(Event{Kind: Evicted, Readers: len(b.rh), N: n})
+	b.wwait.Broadcast()
+	return n, err
+}
+
+// Discard drops up to n bytes from the front of the buffer, but only bytes which every reader has
+// already passed (any number of bytes if there are no readers), Keep is ignored but ExpectReaders isn't. It returns the #
+// of bytes actually dropped, and io.EOF if the buffer is now empty.
+func (b *Buffer) Discard(n int) (int, error) {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.rh) > 0 {
+		if passed := b.rh.Peek().off - b.off; n > passed {
+			n = passed
+		}
+	}
+	if n <= 0 || b.expect > 0 {
+		return 0, nil
+	}
+	return b.evict(n)
+}
+
 // NumReaders returns the number of readers returned by NextReader() which have not called Reader.Close().
 // This method is safe to call concurrently with all methods.
 func (b *Buffer) NumReaders() int {
@@ -162,41 +610,218 @@ func (b *Buffer) OnLastReaderClose(runOnLastClose func() error) {
 	b.callback.Store(runOnLastClose)
 }
 
+// LastReaderClosed returns a channel which is closed the first time a Reader.Close drops NumReaders() to 0,
+// the same point OnLastReaderClose's callback runs. Unlike the callback it only fires once.
+// This method is safe to call concurrently with all other methods.
+func (b *Buffer) LastReaderClosed() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lastClosed == nil {
+		b.lastClosed = make(chan struct{})
+		if b.lastGone {
+			close(b.lastClosed)
+		}
+	}
+	return b.lastClosed
+}
+
+// SetPanicHandler registers handler to be called with the value recovered from any panic in a user
+// callback: OnLastReaderClose, SetEventHook, OnBeforeDiscard, SetEmergencyUncap's onUncap, Audit's onDrop,
+// SetReaderGate and SetMemoryPressureFunc. The Buffer remains usable after a recovered panic.
+// The first five run after the Buffer's locks are released. The reader gate and the pressure func run with
+// the Buffer locked, so they must not call the Buffer's methods, and handler is also called with the Buffer
+// locked for their panics. A panicking gate admits the reader, a panicking pressure func reports no pressure.
+// Without a handler panics propagate.
+// This method is safe to call concurrently with all other methods.
+func (b *Buffer) SetPanicHandler(handler func(recovered interface{})) {
+	b.panicHandler.Store(handler)
+}
+
+// call runs the user callback f, routing any panic to the panic handler.
+func (b *Buffer) call(f func()) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handler, _ := b.panicHandler.Load().(func(interface{}))
+			if handler == nil {
+				panic(rec)
+			}
+			handler(rec)
+		}
+	}()
+	f()
+}
+
 // NextReader returns a new io.ReadCloser for this shared buffer.
 // Read/Close are safe to call concurrently with the buffers Write/Close methods.
 // Read calls will block if the Buffer is not Closed and contains no data.
 // Note that the returned reader sees all data that is currently in the buffer,
 // data is only dropped out of the buffer once all active readers point to
 // locations in the buffer after that section.
+// The reader is a *BufferReader, use NextBufferReader to get one without a type assertion.
 func (b *Buffer) NextReader() io.ReadCloser {
+	return b.NextBufferReader()
+}
+
+// NextBufferReader is like NextReader, but returns the *BufferReader so its other methods can be called.
+func (b *Buffer) NextBufferReader() *BufferReader {
+	r, _ := b.nextReader(false)
+	return r
+}
+
+// nextReader creates a reader like NextReader, if checked is true the reader gate and max readers may refuse it.
+func (b *Buffer) nextReader(checked bool) (*BufferReader, error) {
+	defer b.flush()
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	r := &reader{
+	r := &BufferReader{
 		buf:  b,
-		size: b.buf.Len(),
+		size: b.end() - b.off,
 		off:  b.off,
-		data: b.buf.NextReader(),
+		data: limit(b.buf.NextReader(), b.end()-b.off),
 	}
-	heap.Push(&b.rh, r)
-	return r
+	if err := b.join(r, checked); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetMaxReaders limits the buffer to n open readers created by NextReaderChecked, NextReaderFromNowChecked,
+// RestoreReaders and NextReaderReplayFrom, which return ErrTooManyReaders once it has n readers. Readers created by other methods still count towards
+// the limit but aren't refused, since they can't report an error. An n <= 0 removes the limit.
+func (b *Buffer) SetMaxReaders(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxReaders = n
+}
+
+// SetReaderGate registers gate to be called before a reader is created by NextReaderChecked, NextReaderFromNowChecked,
+// RestoreReaders or NextReaderReplayFrom, if it returns an error no reader is created and that error is returned.
+// A nil gate admits all readers. The gate is called with the Buffer locked, so no reader can join between
+// the gate admitting a reader and it joining, but the gate must not call the Buffer's methods.
+// NextReader, NextReaderFromNow and NextReaders can't report an error and so don't consult the gate.
+// This method is safe to call concurrently with all other methods.
+func (b *Buffer) SetReaderGate(gate func() error) {
+	b.gate.Store(gate)
+}
+
+// admit runs the reader gate, if any. b.mu must be held.
+func (b *Buffer) admit() (err error) {
+	if gate, _ := b.gate.Load().(func() error); gate != nil {
+		b.call(func() { err = gate() })
+	}
+	return err
+}
+
+// NextReaderChecked is like NextReader, but returns the reader gate's error instead of a reader if it rejects it,
+// or ErrTooManyReaders if the buffer already has its max readers.
+func (b *Buffer) NextReaderChecked() (*BufferReader, error) {
+	return b.nextReader(true)
+}
+
+// NextReaderFromNowChecked is like NextReaderFromNow, but returns the reader gate's error instead of a reader if it rejects it,
+// or ErrTooManyReaders if the buffer already has its max readers.
+func (b *Buffer) NextReaderFromNowChecked() (*BufferReader, error) {
+	return b.nextReaderFromNow(true)
+}
+
+// NextReaders returns n new readers like NextReader, all starting at the same offset.
+// It creates them all at once, which is cheaper than calling NextReader n times.
+func (b *Buffer) NextReaders(n int) []*BufferReader {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rs := make([]*BufferReader, n)
+	for i := range rs {
+		rs[i] = &BufferReader{
+			buf:  b,
+			size: b.end() - b.off,
+			off:  b.off,
+			data: limit(b.buf.NextReader(), b.end()-b.off),
+		}
+		b.enroll(rs[i], true)
+	}
+	heap.Init(&b.rh)
+	b.wwait.Broadcast() // writers may be waiting for readers to join
+	return rs
 }
 
 // NextReaderFromNow returns a new io.ReadCloser for this shared buffer.
 // Unlike NextReader(), this reader will only see writes which occur after this reader is returned
 // even if there is other data in the buffer. In other words, this reader points to the end
 // of the buffer.
+// The reader is a *BufferReader, use NextBufferReaderFromNow to get one without a type assertion.
 func (b *Buffer) NextReaderFromNow() io.ReadCloser {
+	return b.NextBufferReaderFromNow()
+}
+
+// NextBufferReaderFromNow is like NextReaderFromNow, but returns the *BufferReader so its other methods can be called.
+func (b *Buffer) NextBufferReaderFromNow() *BufferReader {
+	r, _ := b.nextReaderFromNow(false)
+	return r
+}
+
+// nextReaderFromNow creates a reader like NextReaderFromNow, if checked is true the reader gate and max readers may refuse it.
+func (b *Buffer) nextReaderFromNow(checked bool) (*BufferReader, error) {
+	defer b.flush()
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	l := b.buf.Len()
-	r := &reader{
+	l := b.end() - b.off
+	r := &BufferReader{
 		buf:  b,
 		off:  b.off + l,
 		data: b.buf.NextReader(),
 	}
 	r.data.Discard(l)
-	heap.Push(&b.rh, r)
-	return r
+	r.data = limit(r.data, 0)
+	if err := b.join(r, checked); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NextFinalReader returns a new io.ReadCloser for this shared buffer whose Read blocks until the buffer
+// is closed, then reads everything from the position NextReader would have started at.
+// It's a normal reader which holds its place in the buffer, so it retains everything written after
+// it was created until it reads it, if this buffer has a cap writes will block once it's reached.
+func (b *Buffer) NextFinalReader() io.ReadCloser {
+	return finalReader{b.NextBufferReader()}
+}
+
+// Barrier returns the absolute offset of the end of the data visible to readers, the # of bytes written to the
+// buffer so far (excluding an incomplete write, see CompleteWritesOnly). It can be passed to NextReaderUpTo to
+// read a consistent prefix of the buffer.
+func (b *Buffer) Barrier() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.end())
+}
+
+// NextReaderUpTo returns a new reader like NextReader, which returns io.EOF once it reaches the
+// barrier offset (see Barrier) regardless of later writes.
+func (b *Buffer) NextReaderUpTo(barrier int64) io.ReadCloser {
+	r := b.NextBufferReader()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &limitedReader{r: r, barrier: barrier, next: int64(r.tell())}
+}
+
+// Endpoint returns an io.ReadWriteCloser whose Write writes to this buffer, and whose Read reads from
+// a single reader created by NextReader when Endpoint is called. It's not a fan-out, every Endpoint has its own
+// reader. Closing the Endpoint closes both its reader and the buffer.
+func (b *Buffer) Endpoint() io.ReadWriteCloser {
+	return &endpoint{Buffer: b, r: b.NextBufferReader()}
+}
+
+type endpoint struct {
+	*Buffer
+	r *BufferReader
+}
+
+func (e *endpoint) Read(p []byte) (int, error) { return e.r.Read(p) }
+
+func (e *endpoint) Close() error {
+	e.r.Close()
+	return e.Buffer.Close()
 }
 
 // Len returns the current size of the buffer. This is safe to call concurrently with all other methods.
@@ -206,56 +831,872 @@ func (b *Buffer) Len() int {
 	return b.buf.Len()
 }
 
+// DumpTo writes the bytes currently retained by the Buffer to w, without creating a reader or affecting
+// eviction. It's a point-in-time dump: writes which happen after DumpTo is called aren't included, and the
+// Buffer stays locked while w is written to, so Writes and Reads block until it returns.
+func (b *Buffer) DumpTo(w io.Writer) (n int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return io.Copy(w, b.buf.NextReader())
+}
+
+// Snapshot returns a copy of the bytes currently retained by the Buffer, like DumpTo but into a new slice owned
+// by the caller. It doesn't create a reader or affect eviction, and only locks the Buffer while it copies.
+func (b *Buffer) Snapshot() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := make([]byte, b.buf.Len())
+	n, err := io.ReadFull(b.buf.NextReader(), p)
+	return p[:n], err
+}
+
+// Contiguous returns the size of the largest contiguous writable region of the underlying Writer,
+// ok is false if the Writer doesn't report it (only Writers returned by NewMemoryWriter do).
+// This is safe to call concurrently with all other methods.
+func (b *Buffer) Contiguous() (n int, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.buf.(interface{ Contiguous() int }); ok {
+		return c.Contiguous(), true
+	}
+	return 0, false
+}
+
+// RecordSize makes readers return whole records of n bytes from Read, a trailing partial record
+// is held by the reader until the rest of it is written, or returned at the end of the buffer.
+// Read returns io.ErrShortBuffer if it's passed fewer than n bytes to read into.
+// It applies to readers created after it's called, a n <= 0 disables it.
+func (b *Buffer) RecordSize(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.record = n
+}
+
+// SetMaxLag limits how far behind the newest write readers may fall, readers more than lag bytes behind
+// are advanced so they no longer hold data in the buffer, and skip the bytes they missed. This bounds
+// the memory held for slow readers without blocking the writer like a cap does. Bytes a reader has
+// already been handed by the buffer are still read, so it may briefly read behind the limit.
+// Each reader reports the # of bytes it skipped from Dropped. A lag <= 0 disables the limit.
+// The limit is only enforced for Writers returned by NewMemoryWriter.
+//
+// Note that MaxLag doesn't return this limit, it returns the current lag of the slowest reader.
+func (b *Buffer) SetMaxLag(lag int) {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxLag = lag
+	b.enforceMaxLag()
+}
+
+// enforceMaxLag advances readers which are more than maxLag bytes behind the end of the buffer. b.mu must be held.
+func (b *Buffer) enforceMaxLag() {
+	w, ok := b.buf.(*writer)
+	if b.maxLag <= 0 || !ok || len(b.rh) == 0 {
+		return
+	}
+
+	target := b.off + w.Len() - b.maxLag
+	if b.rh.Peek().off >= target {
+		return
+	}
+
+	pinned := false // whether an advanced reader's snapshot may reference the ring's memory
+	for _, r := range b.rh {
+		if r.off >= target || r.protected {
+			continue
+		}
+		if r.size > 0 {
+			pinned = true
+		}
+		if n := b.advance(r, target); n > 0 {
+			b.emit(Event{Kind: ReaderLagged, Readers: len(b.rh), N: n})
+		}
+	}
+	b.advanced(w, pinned)
+}
+
+// advance moves r to target, unless its current snapshot ends after it since r still reads it.
+// It returns the # of bytes r skipped. b.mu must be held, and advanced called afterwards.
+func (b *Buffer) advance(r *BufferReader, target int) (n int) {
+	end := r.off + r.size
+	if end < target {
+		n = target - end
+		r.dropped += n
+		end = target
+	}
+	r.off, r.size = end, 0
+	return n
+}
+
+// advanced restores the heap and evicts after readers were advanced, pinned is whether an advanced
+// reader's snapshot may reference the ring's memory. b.mu must be held.
+func (b *Buffer) advanced(w *writer, pinned bool) {
+	heap.Init(&b.rh)
+	b.shift()
+
+	if pinned { // move to new memory so writes don't overwrite the advanced readers' snapshots
+		b.buf = w.realloc(w.Cap())
+	}
+}
+
+// BufferFullBehavior is what a Write does when a capped buffer is full, see SetFullBehavior.
+type BufferFullBehavior int
+
+const (
+	// BlockWriter makes writes wait until readers make room, it's the default.
+	BlockWriter BufferFullBehavior = iota
+
+	// DropSlowestReader makes room for writes by advancing the readers holding the oldest data, like SetMaxLag.
+	// Each advanced reader's next read returns ErrDropped, and a ReaderLagged event is emitted.
+	DropSlowestReader
+
+	// CloseSlowestReader makes room for writes by closing the reader holding the oldest data while there's more
+	// than one reader, the last reader blocks writes like BlockWriter. A closed reader's reads return ErrSlowReader.
+	CloseSlowestReader
+)
+
+// SetFullBehavior sets what a Write does when the capped buffer is full. Writes still block if the space
+// can't be freed by advancing readers, ex. it's held by Keep or protected readers (see BufferReader.Protect).
+// DropSlowestReader only applies to Writers returned by NewMemoryWriter, CloseSlowestReader to any Writer.
+func (b *Buffer) SetFullBehavior(fb BufferFullBehavior) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fullBehavior = fb
+}
+
+// dropSlowest advances the readers holding the oldest data so that need more bytes fit under the cap.
+// b.mu must be held.
+func (b *Buffer) dropSlowest(need int) {
+	w, ok := b.buf.(*writer)
+	if !ok || !b.capped() || len(b.rh) == 0 {
+		return
+	}
+	if need > b.cap {
+		need = b.cap
+	}
+
+	target := b.off + w.Len() - b.cap + need
+	if b.rh.Peek().off >= target {
+		return
+	}
+
+	pinned := false
+	for _, r := range b.rh {
+		if r.off >= target || r.protected {
+			continue
+		}
+		if r.size > 0 {
+			pinned = true
+		}
+		if n := b.advance(r, target); n > 0 {
+			atomic.StoreInt32(&r.skipped, 1)
+			b.emit(Event{Kind: ReaderLagged, Readers: len(b.rh), N: n})
+		}
+	}
+	b.advanced(w, pinned)
+}
+
+// slowestToClose returns the reader CloseSlowestReader should close to make room for a write, if any. b.mu must be held.
+func (b *Buffer) slowestToClose() *BufferReader {
+	if len(b.rh) < 2 {
+		return nil
+	}
+	if r := b.rh.Peek(); !r.protected && r.off < b.off+b.buf.Len() { // closing it may free space
+		return r
+	}
+	return nil
+}
+
+// SetMaxReaderAge limits how long a reader may go without reading while it holds data in the buffer,
+// readers which haven't read for longer than d are advanced to the end of the buffer like SetMaxLag,
+// and a ReaderExpired event is emitted. This unblocks eviction held up by stuck readers rather than
+// slow ones. Readers blocked in Read waiting for data are never expired. Readers are checked by a
+// background goroutine every d/4, so a reader may go up to 5/4 d without reading before it's expired.
+// A d <= 0 disables the limit. The limit is only enforced for Writers returned by NewMemoryWriter.
+func (b *Buffer) SetMaxReaderAge(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxAge = d
+	b.ageGen++
+	if d > 0 {
+		go b.sweep(b.ageGen, d/4+1, b.done)
+	}
+}
+
+// sweep expires readers every interval until done is closed (by closing the Buffer) or the max reader age is changed.
+func (b *Buffer) sweep(gen int, interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if !b.expireReaders(gen) {
+			return
+		}
+	}
+}
+
+// expireReaders advances readers older than the max reader age, it returns false if gen is outdated.
+func (b *Buffer) expireReaders(gen int) bool {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ageGen != gen {
+		return false
+	}
+
+	w, ok := b.buf.(*writer)
+	if !ok || len(b.rh) == 0 {
+		return true
+	}
+
+	now, end := b.now(), b.off+w.Len()
+	moved, pinned := false, false
+	for _, r := range b.rh {
+		if r.waiting || r.protected || r.off+r.size >= end || now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastRead))) <= b.maxAge {
+			continue
+		}
+		if r.size > 0 {
+			pinned = true
+		}
+		moved = true
+		b.emit(Event{Kind: ReaderExpired, Readers: len(b.rh), N: b.advance(r, end)})
+	}
+	if moved {
+		b.advanced(w, pinned)
+	}
+	return true
+}
+
+// Sync calls Sync on the underlying Writer if it's Flushable, otherwise it does nothing and returns nil.
+// This can be used to checkpoint important writes to a durable Writer, it's potentially slow
+// (ex. an fsync) and blocks other Buffer methods until it completes.
+func (b *Buffer) Sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f, ok := b.buf.(Flushable); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Truncate drops the last n bytes written to the buffer, as long as no reader has read them yet.
+// It returns the # of bytes actually dropped, if fewer than n bytes could be dropped because a reader
+// has already read them it returns ErrTruncateRead. Any bytes a reader has been handed by the buffer
+// count as read, even if the reader hasn't returned them from Read yet.
+// The underlying Writer must support truncation (Writers returned by NewMemoryWriter do), or ErrNotSupported is returned.
+func (b *Buffer) Truncate(n int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.buf.(interface{ Truncate(int) (int, error) })
+	if !ok {
+		return 0, ErrNotSupported
+	}
+
+	end := b.off + b.buf.Len()
+	avail := b.buf.Len()
+	for _, r := range b.rh {
+		if read := r.off + r.size; end-read < avail {
+			avail = end - read
+		}
+	}
+
+	var err error
+	if n > avail {
+		n, err = avail, ErrTruncateRead
+	}
+	if n <= 0 {
+		return 0, err
+	}
+
+	m, terr := t.Truncate(n)
+	if terr != nil {
+		err = terr
+	}
+	b.truncateMessages()
+	b.wsum = nil        // the stream's hash can't drop the truncated bytes, stop checking integrity
+	b.wwait.Broadcast() // blocking writes may have room now
+	return m, err
+}
+
+// SetEmergencyUncap makes a Write which has been blocked on the cap for longer than after ignore
+// the cap, and calls onTrigger (if not nil) to alert that it happened. The cap is ignored until
+// readers drain the buffer below the cap again. This trades the memory guarantee of the cap for
+// liveness, so a stalled reader can't block the writer forever. Blocked writes are checked every after/4,
+// so a write may block for up to 5/4 after before the cap is ignored. An after <= 0 disables it.
+func (b *Buffer) SetEmergencyUncap(after time.Duration, onTrigger func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.uncapAfter = after
+	b.onUncap = onTrigger
+}
+
+// capped returns whether writes are limited by the cap.
+func (b *Buffer) capped() bool {
+	return b.cap > 0 && !b.uncapped
+}
+
+// full returns whether writes must wait for space, because the buffer is at its cap or, without a cap,
+// at its soft limit. b.mu must be held.
+func (b *Buffer) full() bool {
+	if b.cap == 0 {
+		return b.soft > 0 && b.buf.Len() >= b.soft
+	}
+	return b.capped() && b.buf.Len() >= b.cap
+}
+
+// SetCap changes the buffer's cap to n, an n <= 0 removes it. If the buffer holds more than n bytes
+// nothing is dropped, writes wait until readers drain it below the new cap. A Keep which isn't smaller
+// than the new cap is lowered to n-1, since the buffer couldn't accept new bytes otherwise.
+func (b *Buffer) SetCap(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.wwait.Broadcast() // writers may have room now
+	if n < 0 {
+		n = 0
+	}
+	b.cap = n
+	if n > 0 && b.keep >= n {
+		b.keep = n - 1
+	}
+	if b.uncapped && b.buf.Len() < b.cap {
+		b.uncapped = false
+	}
+}
+
+// Cap returns the buffer's cap, 0 if it isn't capped.
+func (b *Buffer) Cap() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cap
+}
+
+// PostCloseRetention makes the buffer keep the data it holds when it's closed for d, even once every
+// reader has read it, so readers created shortly after Close can still read the final content.
+// After d the data is evicted as usual, all of it if there are no readers. A d <= 0 disables it.
+func (b *Buffer) PostCloseRetention(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retain = d
+}
+
+// release ends the post close retention, unless the buffer was Reset since it was closed.
+func (b *Buffer) release(gen int) {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.resets != gen {
+		return
+	}
+	b.retaining = false
+	if len(b.rh) == 0 {
+		b.evict(b.buf.Len())
+	} else {
+		b.shift()
+	}
+}
+
+// SoftLimit makes writes to a buffer without a cap block while it holds limit or more bytes, until
+// readers advance and free space. Unlike a cap, a write which starts below the limit is written whole
+// even if it goes over it. It has no effect on capped buffers, and a limit <= 0 removes it.
+func (b *Buffer) SoftLimit(limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.wwait.Broadcast() // the limit may have been raised
+	b.soft = limit
+}
+
+// waitForSpace blocks until there's room in the buffer under its cap or soft limit, the buffer is closed,
+// the emergency uncap triggers, or ctx is done. It returns false if there's no room because ctx is done.
+// b.mu must be held.
+func (b *Buffer) waitForSpace(ctx context.Context) bool {
+	if ctx.Done() != nil {
+		defer b.wakeOnDone(ctx)()
+	}
+
+	if b.uncapAfter > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go b.watchUncap(b.now(), b.uncapAfter, done)
+	}
+
+	for b.full() && b.alive() && ctx.Err() == nil { // wait for space
+		b.wwait.Wait()
+	}
+	return !(ctx.Err() != nil && b.full() && b.alive())
+}
+
+// watchUncap uncaps the buffer once a write which started waiting for space at since has waited for
+// longer than after, checking every after/4 until done is closed (once the write stops waiting).
+func (b *Buffer) watchUncap(since time.Time, after time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(after/4 + 1)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		b.mu.Lock()
+		trigger := b.capped() && b.buf.Len() >= b.cap && b.now().Sub(since) >= after
+		select {
+		case <-done: // the write stopped waiting while this waited for the lock
+			trigger = false
+		default:
+		}
+		if trigger {
+			b.uncapped = true
+			b.wwait.Broadcast()
+		}
+		onUncap := b.onUncap
+		b.mu.Unlock()
+		if trigger {
+			if onUncap != nil {
+				b.call(onUncap)
+			}
+			return
+		}
+	}
+}
+
+// wakeOnDone wakes waiting writers once ctx is done, until the returned func is called.
+func (b *Buffer) wakeOnDone(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.wwait.Broadcast()
+			b.mu.Unlock()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// waitForTurn blocks while another write is in progress when only complete writes are visible, until it completes,
+// the buffer is closed, or ctx is done. b.mu must be held.
+func (b *Buffer) waitForTurn(ctx context.Context) error {
+	if b.inflight == 0 {
+		return nil
+	}
+	if ctx.Done() != nil {
+		defer b.wakeOnDone(ctx)()
+	}
+	for b.inflight > 0 && b.alive() && ctx.Err() == nil {
+		b.wwait.Wait()
+	}
+	if !b.alive() {
+		return b.closed()
+	}
+	return ctx.Err()
+}
+
 // Write appends the given data to the buffer. All active readers will
 // see this write.
-func (b *Buffer) Write(p []byte) (int, error) {
+func (b *Buffer) Write(p []byte) (n int, err error) {
+	n, _, err = b.writeDefault(0, p)
+	return n, err
+}
+
+// writeDefault writes p from producer id bounded by the buffer's write deadline, if it has one.
+func (b *Buffer) writeDefault(id int, p []byte) (n int, blocked bool, err error) {
+	b.mu.Lock()
+	t := b.writeDeadline
+	b.mu.Unlock()
+	if t.IsZero() {
+		return b.write(context.Background(), id, p)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), t)
+	defer cancel()
+	if n, blocked, err = b.write(ctx, id, p); err == context.DeadlineExceeded {
+		err = ErrWriteTimeout
+	}
+	return n, blocked, err
+}
+
+// WriteString is like Write, but takes a string without copying it to a []byte first. It implements
+// io.StringWriter so io.WriteString uses it.
+func (b *Buffer) WriteString(s string) (n int, err error) {
+	n, _, err = b.writeDefault(0, stringBytes(s))
+	return n, err
+}
+
+// WriteByte writes c to the buffer like Write, blocking on the cap, and implements io.ByteWriter.
+func (b *Buffer) WriteByte(c byte) error {
+	_, _, err := b.writeDefault(0, []byte{c})
+	return err
+}
+
+// ReadFrom writes everything read from r to the buffer until io.EOF, blocking on the cap like Write, so
+// io.Copy(buf, r) uses it. It returns the # of bytes written and the first error encountered, r ending
+// normally isn't an error, and the buffer being closed mid-copy returns the same error as Write after Close.
+func (b *Buffer) ReadFrom(r io.Reader) (n int64, err error) {
+	scratch := make([]byte, 32*1024)
+	for {
+		m, rerr := r.Read(scratch)
+		if m > 0 {
+			m, err = b.Write(scratch[:m])
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// Requeue re-enqueues p, data which a reader read but failed to process, so another reader can pick it up.
+// It appends p like Write rather than inserting it before the data still in the buffer, so readers which
+// share a position (see NewReaderGroup) read it after what was already buffered, and every other reader
+// reads it again too.
+func (b *Buffer) Requeue(p []byte) (n int, err error) {
+	return b.Write(p)
+}
+
+// WriteDeadline is like Write, but stops waiting for room under the cap once t passes. It returns the
+// # of bytes accepted and ErrWriteTimeout if that's less than len(p), the caller may retry the rest with p[n:].
+// Waiting for initial readers (see WaitForInitialReaders) or a paused buffer also stops once t passes.
+func (b *Buffer) WriteDeadline(p []byte, t time.Time) (n int, err error) {
+	ctx, cancel := context.WithDeadline(context.Background(), t)
+	defer cancel()
+	if n, _, err = b.write(ctx, 0, p); err == context.DeadlineExceeded {
+		err = ErrWriteTimeout
+	}
+	return n, err
+}
+
+// WriteContext is like Write, but stops waiting for room under the cap once ctx is done. It returns the
+// # of bytes accepted and ctx.Err() if that's less than len(p), the caller may retry the rest with p[n:].
+// Waiting for initial readers (see WaitForInitialReaders) or a paused buffer also stops once ctx is done.
+func (b *Buffer) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	n, _, err = b.write(ctx, 0, p)
+	return n, err
+}
+
+// WriteReport is like Write, but also reports whether the write blocked
+// because the buffer was at its cap, or under memory pressure (see SetMemoryPressureFunc).
+// Waiting for initial readers, a paused buffer, another producer or an earlier write's turn
+// doesn't count as blocked.
+func (b *Buffer) WriteReport(p []byte) (n int, blocked bool, err error) {
+	return b.writeDefault(0, p)
+}
+
+func (b *Buffer) write(ctx context.Context, id int, p []byte) (n int, blocked bool, err error) {
+	defer b.flush()
+	defer func() {
+		if err != nil {
+			b.emit(Event{Kind: WriteFailed, Readers: b.NumReaders(), Err: err})
+		}
+	}()
+
 	if !b.alive() {
-		return 0, io.ErrClosedPipe
+		return 0, false, b.closed()
 	}
 
 	b.mu.Lock()
-	defer b.rwait.Broadcast()
+	defer b.wake()
 	defer b.mu.Unlock()
+	b.writes++
+	tok := b.writes
+	defer b.closeMessage(tok)
 	if !b.alive() {
-		return 0, io.ErrClosedPipe
+		return 0, false, b.closed()
 	}
 
-	var m, n int
-	var err error
+	if !b.started {
+		if err := b.waitForInitialReaders(ctx); err != nil {
+			return 0, false, err
+		}
+		b.started = true
+	}
+
+	if b.complete {
+		if b.capped() && len(p) > b.cap {
+			return 0, false, ErrWriteTooLarge
+		}
+		if err := b.waitForTurn(ctx); err != nil {
+			return 0, false, err
+		}
+		b.visible = b.off + b.buf.Len()
+		b.inflight++
+		defer func() {
+			b.inflight--
+			b.visible = b.off + b.buf.Len()
+			b.wwait.Broadcast() // the next write's turn
+		}()
+	}
+
+	var m int
 	for len(p[n:]) > 0 && err == nil { // bytes left to write
 
-		for b.cap > 0 && b.buf.Len() == b.cap && b.alive() { // wait for space
-			b.wwait.Wait()
+		if err := b.waitForResume(ctx); err != nil {
+			return n, blocked, err
+		}
+		if err := b.waitForProducer(ctx, id); err != nil {
+			return n, blocked, err
+		}
+		if b.fullBehavior == DropSlowestReader && b.full() {
+			b.dropSlowest(len(p[n:]))
+		}
+		if r := b.slowestToClose(); b.fullBehavior == CloseSlowestReader && b.full() && r != nil {
+			atomic.StoreInt32(&r.slow, 1)
+			b.mu.Unlock() // Close locks the buffer
+			r.Close()
+			b.mu.Lock()
+			continue
+		}
+		if b.full() && b.alive() {
+			blocked = true
+			b.emit(Event{Kind: WriteBlocked, Readers: len(b.rh)})
+			b.mu.Unlock() // deliver the event before blocking
+			b.flush()
+			b.mu.Lock()
+			if !b.waitForSpace(ctx) {
+				return n, blocked, ctx.Err()
+			}
+			b.emit(Event{Kind: WriteUnblocked, Readers: len(b.rh)})
+		}
+
+		chunk := len(p[n:])
+		if b.capped() && b.cap-b.buf.Len() < chunk {
+			chunk = b.cap - b.buf.Len()
+		}
+		waited, ok := b.waitForMemory(ctx, chunk)
+		blocked = blocked || waited
+		if !ok {
+			return n, blocked, ctx.Err()
 		}
 
 		if !b.alive() {
-			return n, io.ErrClosedPipe
+			return n, blocked, b.closed()
 		}
 
-		if b.cap == 0 || b.cap-b.buf.Len() > len(p[n:]) { // remaining bytes fit in gap, or no cap.
+		b.openMessage(tok, id)
+		start := b.off + b.buf.Len()
+		if !b.capped() || b.cap-b.buf.Len() > len(p[n:]) { // remaining bytes fit in gap, or no cap.
 			m, err := b.buf.Write(p[n:])
-			return n + m, err
+			b.produced(id, start, start+m)
+			b.audit(p[n : n+m])
+			b.hashWrite(p[n : n+m])
+			b.wrate.add(b.now(), m)
+			b.enforceMaxLag()
+			return n + m, blocked, err
 		}
 
 		gap := b.cap - b.buf.Len() // there is a cap, and we didn't fit in the gap
 		m, err = b.buf.Write(p[n : n+gap])
+		b.produced(id, start, start+m)
+		b.audit(p[n : n+m])
+		b.hashWrite(p[n : n+m])
 		n += m
-		b.rwait.Broadcast() // wake up readers to read the partial write
+		b.wrate.add(b.now(), m)
+		b.enforceMaxLag()
+		if !b.complete {
+			b.wake() // wake up readers to read the partial write
+		}
 	}
-	return n, err
+	return n, blocked, err
+}
+
+// WriteAsync queues p to be written to the buffer by another goroutine and returns a channel which
+// receives the error returned by Write once it's done. Queued writes are written in the order
+// WriteAsync was called. At most MaxAsyncWrites may be queued, after which WriteAsync blocks until
+// a queued write completes. p must not be modified until the result has been received.
+// Writes still queued when the buffer is closed receive the same error as a Write after Close.
+func (b *Buffer) WriteAsync(p []byte) <-chan error {
+	res := make(chan error, 1)
+	b.asyncSem <- struct{}{}
+
+	b.amu.Lock()
+	prev, next := b.asyncTail, make(chan struct{})
+	b.asyncTail = next
+	b.amu.Unlock()
+
+	go func() {
+		defer func() { <-b.asyncSem }()
+		defer close(next)
+		if prev != nil {
+			<-prev // wait for the previous write to finish
+		}
+		_, err := b.Write(p)
+		res <- err
+	}()
+	return res
 }
 
 // Close marks the buffer as complete. Readers will return io.EOF instead of blocking
-// when they reach the end of the buffer.
+// when they reach the end of the buffer. It only returns an error if the DrainOnCloseTo sink fails.
 func (b *Buffer) Close() error {
+	return b.CloseWithError(nil)
+}
+
+// Wait blocks until the buffer is closed and all of its readers have been closed, then returns the buffer's
+// close error (nil if it was closed by Close, see CloseWithError). Unlike closing it only
+// observes the buffer. If ctx is done first it returns ctx.Err().
+func (b *Buffer) Wait(ctx context.Context) error {
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.rwait.Broadcast()
+			b.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for (b.alive() || len(b.rh) > 0) && ctx.Err() == nil {
+		b.rwait.Wait()
+	}
+	if b.alive() || len(b.rh) > 0 {
+		return ctx.Err()
+	}
+	return b.err
+}
+
+// CloseWithError closes the buffer like Close, but if err isn't nil readers return it instead of io.EOF once
+// they've read the remaining buffered bytes (on every Read afterwards, like io.Pipe), and writers return it
+// instead of io.ErrClosedPipe. Only the first close sets the error.
+func (b *Buffer) CloseWithError(err error) (serr error) {
+	var sink io.Writer
+	var rest Reader
+	defer func() { // after unlocking, so a slow or re-entrant sink doesn't block the buffer
+		if sink != nil {
+			_, serr = io.Copy(sink, rest)
+			b.undrain()
+		}
+	}()
+	defer b.flush()
 	b.mu.Lock()
 	defer b.rwait.Broadcast() // readers should wake up since there will be no more writes
 	defer b.wwait.Broadcast() // writers should wake up since blocking writes should unblock
 	defer b.mu.Unlock()
+	if b.alive() {
+		b.err = err
+		close(b.done)
+		if b.retain > 0 {
+			b.retaining = true
+			gen := b.resets
+			time.AfterFunc(b.retain, func() { b.release(gen) })
+		}
+		sink, rest = b.sink, b.undelivered()
+		b.emit(Event{Kind: BufferClosed, Readers: len(b.rh)})
+	}
 	b.kill()
 	return nil
 }
 
+// DrainOnCloseTo makes Close write the data which hasn't been read by every reader to w, so it isn't lost
+// if the readers go away without reading it. That's everything from the oldest position any reader still
+// holds to the end of the buffer (all retained data if there are no readers), so it may include some bytes
+// already read by the slowest reader. Close returns w's error, if any. A nil w disables it.
+// The data is written after the buffer is unlocked, so w may call the Buffer's methods. It's read straight from
+// the Writer (ex. a FileWriter's file) rather than copied into memory first, and kept until w has been written.
+func (b *Buffer) DrainOnCloseTo(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sink = w
+}
+
+// undelivered returns a snapshot of the data not read by every reader for the sink set by DrainOnCloseTo,
+// or nil without a sink. The data is kept in the buffer until undrain is called, so the snapshot can be read
+// after unlocking without copying it into memory first. b.mu must be held.
+func (b *Buffer) undelivered() Reader {
+	if b.sink == nil {
+		return nil
+	}
+	off := b.off
+	if len(b.rh) > 0 {
+		off = b.rh.Peek().off
+	}
+	b.draining, b.drainOff = true, off
+	data := b.buf.NextReader()
+	data.Discard(off - b.off)
+	return data
+}
+
+// undrain lets the buffer evict the data undelivered kept for the sink, once it has been written.
+func (b *Buffer) undrain() {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.draining = false
+	if b.retain > 0 && !b.retaining && len(b.rh) == 0 { // the post close retention ended while draining
+		b.evict(b.buf.Len())
+	} else {
+		b.shift()
+	}
+}
+
+// Reset empties the buffer and reopens it if it was closed, so it can be reused (ex. from a sync.Pool)
+// instead of creating a new one. Its settings (cap, Keep, etc.) are kept, and the memory of a Writer returned
+// by NewMemoryWriter is reused. It returns ErrActiveReaders and does nothing if the buffer still has open
+// readers (or is still draining to its DrainOnCloseTo sink), and it must not be called while writes are in
+// progress. A buffer from NewWithContext isn't closed by its context again after it's been reset.
+func (b *Buffer) Reset() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.rh) > 0 || b.draining {
+		return ErrActiveReaders
+	}
+	b.reset()
+	return nil
+}
+
+// reset is Reset, once it's checked there are no readers. b.mu must be held.
+func (b *Buffer) reset() {
+	if w, ok := b.buf.(*writer); ok {
+		w.off, w.roff, w.empty = 0, 0, true
+	} else {
+		b.buf.Discard(b.buf.Len())
+	}
+	b.resets++
+	b.off, b.visible, b.inflight = 0, 0, 0
+	b.ends = nil
+	b.msgTok, b.msgID = 0, 0
+	b.expect = 0
+	for _, t := range b.throttles {
+		t.spans = nil
+	}
+	b.evmu.Lock()
+	b.discarded = nil
+	b.evmu.Unlock()
+	b.started, b.uncapped, b.retaining = false, false, false
+	b.lastGone, b.lastClosed = false, nil
+	b.opened, b.peak = 0, 0
+	b.wrate, b.rrate = rate{}, rate{}
+	if b.wsum != nil {
+		b.wsum.Reset()
+	}
+	if !b.alive() {
+		b.err = nil
+		b.done = make(chan struct{})
+		b.revive()
+		if b.maxAge > 0 { // the sweep stopped when the buffer was closed
+			b.ageGen++
+			go b.sweep(b.ageGen, b.maxAge/4+1, b.done)
+		}
+	}
+	b.wwait.Broadcast()
+}
+
 // NewBuffer creates and returns a new Buffer backed by the passed Writer
 func NewBuffer(w Writer) *Buffer {
 	return NewCappedBuffer(w, 0)
@@ -272,12 +1713,35 @@ func NewCapped(cap int) *Buffer {
 	return NewCappedBuffer(NewMemoryWriter(nil), cap)
 }
 
+// NewWithContext creates a new in-memory Buffer which is closed when ctx is done. Readers return ctx.Err()
+// instead of io.EOF once they've read everything, and writes return it instead of io.ErrClosedPipe.
+func NewWithContext(ctx context.Context) *Buffer {
+	return NewCappedBufferWithContext(ctx, NewMemoryWriter(nil), 0)
+}
+
+// NewCappedBufferWithContext is like NewCappedBuffer, but the Buffer is closed when ctx is done like NewWithContext.
+func NewCappedBufferWithContext(ctx context.Context, w Writer, cap int) *Buffer {
+	buf := NewCappedBuffer(w, cap)
+	done := buf.done // Reset replaces it
+	go func() {
+		select {
+		case <-ctx.Done():
+			buf.CloseWithError(ctx.Err())
+		case <-done: // closed first, stop waiting
+		}
+	}()
+	return buf
+}
+
 // NewCappedBuffer creates a new Buffer whose Write() call blocks to prevent Len() from exceeding
 // the passed capacity
 func NewCappedBuffer(w Writer, cap int) *Buffer {
 	buf := Buffer{
-		buf: w,
-		cap: cap,
+		buf:      w,
+		cap:      cap,
+		asyncSem: make(chan struct{}, MaxAsyncWrites),
+		done:     make(chan struct{}),
+		now:      time.Now,
 	}
 	buf.rwait = sync.NewCond(&buf.mu)
 	buf.wwait = sync.NewCond(&buf.mu)
@@ -1,12 +1,20 @@
 package bufit
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -99,6 +107,222 @@ func BenchmarkReadWriter(b *testing.B) {
 	b.ReportAllocs()
 }
 
+func BenchmarkSingleReaderDrain(b *testing.B) {
+	buf := New()
+	r := buf.NextReader()
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 32*1024))
+	temp := make([]byte, 32*1024)
+	for i := 0; i < b.N; i++ {
+		buf.Write(data)
+		io.CopyBuffer(ioutil.Discard, io.LimitReader(r, int64(len(data))), temp)
+	}
+	r.Close()
+	b.ReportAllocs()
+}
+
+func BenchmarkNextReaders(b *testing.B) {
+	b.Run("Loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buf := New()
+			for j := 0; j < 1000; j++ {
+				buf.NextReader()
+			}
+		}
+		b.ReportAllocs()
+	})
+
+	b.Run("Bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			New().NextReaders(1000)
+		}
+		b.ReportAllocs()
+	})
+}
+
+type writerOnly struct{ io.Writer }
+
+func BenchmarkCopyBufferTo(b *testing.B) {
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 32*1024))
+	fill := func() *BufferReader {
+		buf := New()
+		r := buf.NextBufferReader()
+		for i := 0; i < 4; i++ {
+			buf.Write(data)
+		}
+		buf.Close()
+		return r
+	}
+
+	b.Run("io.Copy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			r := fill()
+			b.StartTimer()
+			io.Copy(writerOnly{ioutil.Discard}, r)
+		}
+		b.ReportAllocs()
+	})
+
+	b.Run("CopyBufferTo", func(b *testing.B) {
+		scratch := make([]byte, 32*1024)
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			r := fill()
+			b.StartTimer()
+			r.CopyBufferTo(writerOnly{ioutil.Discard}, scratch)
+		}
+		b.ReportAllocs()
+	})
+}
+
+func BenchmarkAppendTo(b *testing.B) {
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 32*1024))
+	fill := func() *BufferReader {
+		buf := New()
+		r := buf.NextBufferReader()
+		for i := 0; i < 4; i++ {
+			buf.Write(data)
+		}
+		buf.Close()
+		return r
+	}
+
+	b.Run("ReadFrom", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			r := fill()
+			var dst bytes.Buffer
+			b.StartTimer()
+			dst.ReadFrom(r)
+		}
+		b.ReportAllocs()
+	})
+
+	b.Run("AppendTo", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			r := fill()
+			var dst bytes.Buffer
+			b.StartTimer()
+			r.AppendTo(&dst, 0)
+		}
+		b.ReportAllocs()
+	})
+}
+
+func BenchmarkPrefaultLatency(b *testing.B) {
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 4*1024))
+	run := func(b *testing.B, prefault bool) {
+		var times []time.Duration
+		for i := 0; i < b.N; i++ {
+			buf := New()
+			if prefault {
+				buf.Prefault(1024 * 1024)
+			}
+			r := buf.NextReader()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				io.Copy(ioutil.Discard, r)
+			}()
+			for j := 0; j < 256; j++ {
+				start := time.Now()
+				buf.Write(data)
+				times = append(times, time.Since(start))
+			}
+			buf.Close()
+			<-done
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		b.ReportMetric(float64(times[len(times)*99/100].Nanoseconds()), "p99-ns/write")
+		b.ReportAllocs()
+	}
+
+	b.Run("Lazy", func(b *testing.B) { run(b, false) })
+	b.Run("Prefault", func(b *testing.B) { run(b, true) })
+}
+
+func BenchmarkReadSpin(b *testing.B) {
+	run := func(b *testing.B, spin int) {
+		ping, pong := New(), New()
+		ping.ReadSpin(spin)
+		pong.ReadSpin(spin)
+		pr, qr := ping.NextReader(), pong.NextReader()
+		go func() { // echo
+			p := make([]byte, 1)
+			for {
+				if _, err := pr.Read(p); err != nil {
+					pong.Close()
+					return
+				}
+				pong.Write(p)
+			}
+		}()
+
+		p := make([]byte, 1)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ping.Write(p)
+			qr.Read(p)
+		}
+		b.StopTimer()
+		ping.Close()
+		ioutil.ReadAll(qr)
+	}
+
+	b.Run("Park", func(b *testing.B) { run(b, 0) })
+	b.Run("Spin", func(b *testing.B) { run(b, 10000) })
+}
+
+func BenchmarkReadWriterWrapped(b *testing.B) {
+	buf := newWriter(make([]byte, 0, 32*1024))
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 7*1024))
+	grows := 0
+	for i := 0; i < b.N; i++ {
+		c := buf.Cap()
+		buf.Write(data)
+		if buf.Cap() != c {
+			grows++
+		}
+		if buf.Len() > 3*len(data) {
+			buf.Discard(2 * len(data))
+		}
+	}
+	b.ReportMetric(float64(grows), "grows")
+	b.ReportAllocs()
+}
+
+func TestWriterContiguous(t *testing.T) {
+	buf := newWriter(make([]byte, 0, 10))
+	if c := buf.Contiguous(); c != 10 {
+		t.Errorf("expected 10 contiguous bytes in empty writer, got %d", c)
+	}
+
+	io.WriteString(buf, "1234567")
+	buf.Discard(5)
+	if c := buf.Contiguous(); c != 5 {
+		t.Errorf("expected 5 contiguous bytes before roff, got %d", c)
+	}
+
+	io.WriteString(buf, "89a") // wraps
+	if c := buf.Contiguous(); c != 5 {
+		t.Errorf("expected 5 contiguous bytes after wrap, got %d", c)
+	}
+	if buf.Cap() != 10 {
+		t.Errorf("expected wrapped write to not grow, got cap %d", buf.Cap())
+	}
+
+	io.WriteString(buf, "bcdef")
+	if c := buf.Contiguous(); c != 0 {
+		t.Errorf("expected no contiguous bytes in full writer, got %d", c)
+	}
+
+	b := NewBuffer(buf)
+	if c, ok := b.Contiguous(); !ok || c != 0 {
+		t.Errorf("expected 0, true got %d, %v", c, ok)
+	}
+}
+
 func TestCappedBuffer(t *testing.T) {
 	data := []byte("Hello World")
 	buf := NewCapped(5)
@@ -132,6 +356,44 @@ func TestCappedBuffer(t *testing.T) {
 	}
 }
 
+func TestWriteReport(t *testing.T) {
+	buf := NewCapped(4)
+	r := buf.NextReader()
+	defer r.Close()
+
+	if n, blocked, err := buf.WriteReport([]byte("ab")); n != 2 || blocked || err != nil {
+		t.Errorf("expected 2, false, nil got %d, %v, %v", n, blocked, err)
+	}
+
+	type report struct {
+		n       int
+		blocked bool
+		err     error
+	}
+	wrote := make(chan report)
+	go func() {
+		n, blocked, err := buf.WriteReport([]byte("cdef"))
+		wrote <- report{n, blocked, err}
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("expected the write to wait on the cap")
+	case <-time.After(30 * time.Millisecond):
+	}
+	p := make([]byte, 6)
+	if _, err := io.ReadFull(r, p); err != nil || string(p) != "abcdef" {
+		t.Errorf("expected abcdef, nil got %s, %v", p, err)
+	}
+	select {
+	case rep := <-wrote:
+		if rep.n != 4 || !rep.blocked || rep.err != nil {
+			t.Errorf("expected 4, true, nil got %d, %v, %v", rep.n, rep.blocked, rep.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the write to finish once there was room")
+	}
+}
+
 func TestReadReaderAfterClose(t *testing.T) {
 	buf := New()
 	r := buf.NextReader()
@@ -276,6 +538,18 @@ func assertNumReaders(n int, buf *Buffer, t *testing.T) {
 	}
 }
 
+// debugRing returns the raw ring state of the buffer's memory for diagnosing wrap bugs: the write head,
+// the oldest unread byte, the capacity and whether it's empty (off == roff is ambiguous without it).
+// ok is false for Writers not returned by NewMemoryWriter.
+func (b *Buffer) debugRing() (off, roff, cap int, empty, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w, isWriter := b.buf.(*writer); isWriter {
+		return w.off, w.roff, w.Cap(), w.empty, true
+	}
+	return 0, 0, 0, false, false
+}
+
 func TestCloseCallback(t *testing.T) {
 	called := false
 	buf := New()
@@ -456,3 +730,3731 @@ func ExampleBuffer() {
 	// HelloHelloHello World
 	//  World
 }
+
+func TestTruncate(t *testing.T) {
+	buf := New()
+	r := buf.NextReaderFromNow()
+	defer r.Close()
+
+	io.WriteString(buf, "hello")
+	p := make([]byte, 3)
+	if _, err := io.ReadFull(r, p); err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(buf, " world")
+	if n, err := buf.Truncate(6); n != 6 || err != nil {
+		t.Errorf("expected 6, nil got %d, %v", n, err)
+	}
+	if buf.Len() != 5 {
+		t.Errorf("expected len to be 5 but got %d", buf.Len())
+	}
+
+	if n, err := buf.Truncate(3); n != 0 || err != ErrTruncateRead {
+		t.Errorf("expected 0, %v got %d, %v", ErrTruncateRead, n, err)
+	}
+
+	io.WriteString(buf, " there")
+	if n, err := buf.Truncate(10); n != 6 || err != ErrTruncateRead {
+		t.Errorf("expected 6, %v got %d, %v", ErrTruncateRead, n, err)
+	}
+
+	io.WriteString(buf, "!")
+	buf.Close()
+	out, _ := ioutil.ReadAll(r)
+	if string(out) != "lo!" {
+		t.Errorf("expected lo! got %s", out)
+	}
+}
+
+func TestReadAtLeastOrAvailableBurst(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		io.WriteString(buf, "a")
+	}()
+
+	p := make([]byte, 10)
+	n, err := r.ReadAtLeastOrAvailable(p, 1)
+	if n != 1 || err != nil || string(p[:n]) != "a" {
+		t.Errorf("expected 1, nil got %d, %v", n, err)
+	}
+
+	io.WriteString(buf, "bcd")
+	io.WriteString(buf, "efg")
+	n, err = r.ReadAtLeastOrAvailable(p, 1)
+	if n != 6 || err != nil || string(p[:n]) != "bcdefg" {
+		t.Errorf("expected bcdefg, nil got %s, %v", p[:n], err)
+	}
+}
+
+func TestReadAtLeastOrAvailableTrickle(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			<-time.After(10 * time.Millisecond)
+			io.WriteString(buf, "a")
+		}
+		buf.Close()
+	}()
+
+	p := make([]byte, 10)
+	n, err := r.ReadAtLeastOrAvailable(p, 3)
+	if n < 3 || err != nil {
+		t.Errorf("expected at least 3 bytes, got %d, %v", n, err)
+	}
+
+	m, err := r.ReadAtLeastOrAvailable(p, 5)
+	if expect := io.ErrUnexpectedEOF; n+m != 5 || (err != expect && !(m == 0 && err == io.EOF)) {
+		t.Errorf("expected %d, %v got %d, %v", 5-n, expect, m, err)
+	}
+
+	if _, err := r.ReadAtLeastOrAvailable(p, 11); err != io.ErrShortBuffer {
+		t.Errorf("expected %v got %v", io.ErrShortBuffer, err)
+	}
+}
+
+func TestEventHook(t *testing.T) {
+	buf := NewCapped(5)
+
+	var mu sync.Mutex
+	var kinds []EventKind
+	evicted := 0
+	buf.SetEventHook(func(ev Event) {
+		buf.Len() // hooks may call back into the buffer
+		mu.Lock()
+		defer mu.Unlock()
+		kinds = append(kinds, ev.Kind)
+		if ev.Kind == Evicted {
+			evicted += ev.N
+		}
+	})
+
+	r := buf.NextReader()
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		io.Copy(ioutil.Discard, r)
+		r.Close()
+	}()
+
+	io.WriteString(buf, "hello world")
+	buf.Close()
+	<-time.After(50 * time.Millisecond)
+	io.WriteString(buf, "closed")
+
+	mu.Lock()
+	defer mu.Unlock()
+	count := map[EventKind]int{}
+	for _, k := range kinds {
+		count[k]++
+	}
+	if kinds[0] != ReaderJoined || kinds[len(kinds)-1] != WriteFailed {
+		t.Errorf("expected events to start with ReaderJoined and end with WriteFailed, got %v", kinds)
+	}
+	if count[WriteBlocked] == 0 || count[WriteBlocked] != count[WriteUnblocked] {
+		t.Errorf("expected matching WriteBlocked/WriteUnblocked events, got %v", kinds)
+	}
+	if count[ReaderLeft] != 1 || count[BufferClosed] != 1 {
+		t.Errorf("expected a single ReaderLeft and BufferClosed events, got %v", kinds)
+	}
+	if evicted != len("hello world") {
+		t.Errorf("expected %d bytes evicted, got %d", len("hello world"), evicted)
+	}
+}
+
+func TestCloseTwiceEmitsOnce(t *testing.T) {
+	buf := New()
+	closed := 0
+	buf.SetEventHook(func(ev Event) {
+		if ev.Kind == BufferClosed {
+			closed++
+		}
+	})
+	buf.Close()
+	buf.CloseWithError(io.ErrUnexpectedEOF)
+	if closed != 1 {
+		t.Errorf("expected a single BufferClosed event got %d", closed)
+	}
+}
+
+func TestWriterDiscardCounts(t *testing.T) {
+	for _, test := range []struct {
+		discard, n, len int
+		err             error
+	}{
+		{discard: 5, n: 5, len: 0, err: io.EOF},
+		{discard: 4, n: 4, len: 1},
+		{discard: 10, n: 5, len: 0, err: io.EOF},
+		{discard: -1, n: 0, len: 5},
+	} {
+		buf := newWriter(make([]byte, 0, 8))
+		io.WriteString(buf, "abc")
+		buf.Discard(3)
+		io.WriteString(buf, "hello") // wraps the ring
+
+		n, err := buf.Discard(test.discard)
+		if n != test.n || err != test.err {
+			t.Errorf("Discard(%d): expected %d, %v got %d, %v", test.discard, test.n, test.err, n, err)
+		}
+		if buf.Len() != test.len || buf.empty != (test.len == 0) {
+			t.Errorf("Discard(%d): expected len %d got %d (empty %v)", test.discard, test.len, buf.Len(), buf.empty)
+		}
+	}
+}
+
+func TestFileWriter(t *testing.T) {
+	w, err := NewTempFileWriter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := NewBuffer(w)
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 64*1024))
+	rs := buf.NextReaders(2)
+	var grp sync.WaitGroup
+	for _, r := range rs {
+		grp.Add(1)
+		go func(r *BufferReader) {
+			defer grp.Done()
+			defer r.Close()
+			if got, _ := ioutil.ReadAll(r); !bytes.Equal(got, data) {
+				t.Errorf("expected to read all %d bytes got %d", len(data), len(got))
+			}
+		}(r)
+	}
+	for p := data; len(p) > 0; p = p[1024:] {
+		buf.Write(p[:1024])
+	}
+	buf.Close()
+	grp.Wait()
+
+	if buf.Len() != 0 {
+		t.Errorf("expected the buffer to be drained got len %d", buf.Len())
+	}
+	if fi, err := w.f.Stat(); err != nil || fi.Size() != 0 {
+		t.Errorf("expected the drained file to be truncated got size %v, %v", fi.Size(), err)
+	}
+	if err := buf.Sync(); err != nil {
+		t.Errorf("expected nil from Sync got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("expected nil from Close got %v", err)
+	}
+	if _, err := os.Stat(w.f.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the temp file to be removed got %v", err)
+	}
+}
+
+func TestFileWriterPunchHole(t *testing.T) {
+	w, err := NewTempFileWriter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	buf := NewBuffer(w)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 3*PunchThreshold))
+	var got []byte
+	p := make([]byte, 64*1024)
+	for i := 0; i < len(data); i += len(p) {
+		buf.Write(data[i : i+len(p)]) // r never catches up, so the buffer is never drained
+		if i > 0 {
+			n, _ := r.Read(p)
+			got = append(got, p[:n]...)
+		}
+	}
+	if w.nopunch {
+		t.Skip("the file system can't punch holes")
+	}
+	if runtime.GOOS == "linux" && w.punched < PunchThreshold {
+		t.Errorf("expected the discarded bytes' space to be released got %d", w.punched)
+	}
+	buf.Close()
+	rest, _ := ioutil.ReadAll(r)
+	if got = append(got, rest...); !bytes.Equal(got, data) {
+		t.Errorf("expected to read all %d bytes intact got %d", len(data), len(got))
+	}
+}
+
+func TestSpillWriter(t *testing.T) {
+	w := NewSpillWriter(16)
+	defer w.Close()
+	buf := NewBuffer(w)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	io.WriteString(buf, "0123456789")
+	if w.Spilled() {
+		t.Error("expected the bytes to stay in memory under the limit")
+	}
+	p := make([]byte, 4)
+	io.ReadFull(r, p) // keeps a snapshot of the bytes in memory
+	io.WriteString(buf, "abcdefghij")
+	if !w.Spilled() || buf.Len() != 20 {
+		t.Errorf("expected all 20 bytes to spill to a file got spilled %v, len %d", w.Spilled(), buf.Len())
+	}
+	name := w.file.f.Name()
+
+	rest := make([]byte, 16)
+	if _, err := io.ReadFull(r, rest); err != nil || string(rest) != "456789abcdefghij" {
+		t.Errorf("expected 456789abcdefghij, nil got %q, %v", rest, err)
+	}
+	r.SetBlocking(false)
+	r.Read(p) // evicts what was read
+	if w.Spilled() || buf.Len() != 0 {
+		t.Errorf("expected the drained buffer to go back to memory got spilled %v, len %d", w.Spilled(), buf.Len())
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed got %v", err)
+	}
+
+	io.WriteString(buf, "small")
+	if n, err := r.Read(p); w.Spilled() || err != nil || string(p[:n]) != "smal" {
+		t.Errorf("expected smal, nil from memory got %q, %v (spilled %v)", p[:n], err, w.Spilled())
+	}
+}
+
+func TestWriterRing(t *testing.T) {
+	buf := NewBuffer(NewMemoryWriter(make([]byte, 0, 8)))
+	check := func(step string, off, roff int, empty bool) {
+		t.Helper()
+		o, ro, c, e, ok := buf.debugRing()
+		if !ok || o != off || ro != roff || c != 8 || e != empty {
+			t.Errorf("%s: expected ring %d, %d, 8, %v got %d, %d, %d, %v", step, off, roff, empty, o, ro, c, e)
+		}
+		want := (o - ro + c) % c // Len from the raw pointers
+		if want == 0 && !e {
+			want = c
+		}
+		if l := buf.Len(); l != want {
+			t.Errorf("%s: expected len %d from the ring got %d", step, want, l)
+		}
+	}
+
+	check("new", 0, 0, true)
+	io.WriteString(buf, "abcdef")
+	check("write", 6, 0, false)
+	buf.Discard(4)
+	check("discard", 6, 4, false)
+	io.WriteString(buf, "ghijk") // wraps
+	check("wrap", 3, 4, false)
+	io.WriteString(buf, "l") // fills
+	check("full", 4, 4, false)
+	buf.Discard(5) // across the wrap
+	check("discard wrap", 4, 1, false)
+	buf.Discard(3)
+	check("drain", 4, 4, true)
+}
+
+func TestWaitForInitialReaders(t *testing.T) {
+	buf := New()
+	buf.WaitForInitialReaders(1, 0)
+
+	wrote := make(chan struct{})
+	go func() {
+		io.WriteString(buf, "hello")
+		close(wrote)
+	}()
+
+	select {
+	case <-wrote:
+		t.Fatal("expected first write to block until a reader joins")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r := buf.NextReader()
+	select {
+	case <-wrote:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected first write to unblock once a reader joined")
+	}
+	r.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.WriteString(buf, " world")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("expected later writes not to wait for readers")
+	}
+}
+
+func TestWaitForInitialReadersTimeout(t *testing.T) {
+	buf := New()
+	buf.WaitForInitialReaders(2, 50*time.Millisecond)
+	start := time.Now()
+	if _, err := io.WriteString(buf, "hello"); err != nil {
+		t.Error(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected write to wait for the timeout, waited %s", d)
+	}
+}
+
+func TestReaderDiscard(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	io.WriteString(buf, "hello")
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		io.WriteString(buf, " world")
+		buf.Close()
+	}()
+
+	if n, err := r.Discard(6); n != 6 || err != nil {
+		t.Errorf("expected 6, nil got %d, %v", n, err)
+	}
+
+	p := make([]byte, 3)
+	if _, err := io.ReadFull(r, p); err != nil || string(p) != "wor" {
+		t.Errorf("expected wor, nil got %s, %v", p, err)
+	}
+
+	if n, err := r.Discard(5); n != 2 || err != io.EOF {
+		t.Errorf("expected 2, %v got %d, %v", io.EOF, n, err)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("expected discarded bytes to be evicted, got len %d", buf.Len())
+	}
+}
+
+func TestWriteAsyncOrder(t *testing.T) {
+	buf := NewCapped(3)
+	r := buf.NextReader()
+	defer r.Close()
+
+	var expect bytes.Buffer
+	var results []<-chan error
+	for i := 0; i < 10; i++ {
+		p := []byte{byte('a' + i), byte('a' + i)}
+		expect.Write(p)
+		results = append(results, buf.WriteAsync(p))
+	}
+
+	go func() {
+		for _, res := range results {
+			if err := <-res; err != nil {
+				t.Error(err)
+			}
+		}
+		buf.Close()
+	}()
+
+	out, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(out, expect.Bytes()) {
+		t.Errorf("expected %s got %s", expect.Bytes(), out)
+	}
+}
+
+func TestWriteAsyncCloseWhileQueued(t *testing.T) {
+	buf := NewCapped(5)
+	r := buf.NextReader() // never reads, so the buffer stays full
+	defer r.Close()
+
+	first := buf.WriteAsync([]byte("hello"))
+	second := buf.WriteAsync([]byte("world"))
+	third := buf.WriteAsync([]byte("!"))
+
+	if err := <-first; err != nil {
+		t.Errorf("expected first write to succeed, got %v", err)
+	}
+	buf.Close()
+	if err := <-second; err != io.ErrClosedPipe {
+		t.Errorf("expected %v got %v", io.ErrClosedPipe, err)
+	}
+	if err := <-third; err != io.ErrClosedPipe {
+		t.Errorf("expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	buf := NewCapped(4)
+	buf.MessageBoundaries()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	msgs := []string{"hello world", "ab", "c", "defg"}
+	go func() {
+		for _, msg := range msgs {
+			io.WriteString(buf, msg)
+		}
+		buf.Close()
+	}()
+
+	for _, expect := range msgs {
+		msg, err := r.ReadMessage()
+		if err != nil || string(msg) != expect {
+			t.Errorf("expected %s, nil got %s, %v", expect, msg, err)
+		}
+	}
+	if msg, err := r.ReadMessage(); len(msg) != 0 || err != io.EOF {
+		t.Errorf("expected empty message with %v got %s, %v", io.EOF, msg, err)
+	}
+
+	if _, err := New().NextBufferReader().ReadMessage(); err != ErrNoMessages {
+		t.Errorf("expected %v got %v", ErrNoMessages, err)
+	}
+}
+
+func TestReadMessageTruncate(t *testing.T) {
+	buf := New()
+	buf.MessageBoundaries()
+	r := buf.NextBufferReaderFromNow()
+	defer r.Close()
+
+	io.WriteString(buf, "abc")
+	io.WriteString(buf, "defg")
+	buf.Truncate(2)
+	buf.Close()
+
+	for _, expect := range []string{"abc", "de"} {
+		if msg, err := r.ReadMessage(); err != nil || string(msg) != expect {
+			t.Errorf("expected %s, nil got %s, %v", expect, msg, err)
+		}
+	}
+}
+
+func TestNextFinalReader(t *testing.T) {
+	buf := New()
+	r := buf.NextFinalReader()
+	defer r.Close()
+
+	read := make(chan []byte)
+	go func() {
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- out
+	}()
+
+	io.WriteString(buf, "hello")
+	io.WriteString(buf, " world")
+	select {
+	case out := <-read:
+		t.Fatalf("expected final reader to wait for close, got %s", out)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if buf.Len() != len("hello world") {
+		t.Errorf("expected final reader to retain data, got len %d", buf.Len())
+	}
+
+	buf.Close()
+	if out := <-read; string(out) != "hello world" {
+		t.Errorf("expected hello world got %s", out)
+	}
+}
+
+func TestNextFinalReaderCopy(t *testing.T) {
+	buf := New()
+	r := buf.NextFinalReader()
+	defer r.Close()
+	if _, ok := r.(io.WriterTo); ok {
+		t.Errorf("expected the final reader not to bypass its Read with WriteTo")
+	}
+
+	done := make(chan string)
+	go func() {
+		var out bytes.Buffer
+		io.Copy(&out, r)
+		done <- out.String()
+	}()
+
+	io.WriteString(buf, "hello")
+	select {
+	case out := <-done:
+		t.Fatalf("expected io.Copy to wait for close, got %q", out)
+	case <-time.After(20 * time.Millisecond):
+	}
+	buf.Close()
+	if out := <-done; out != "hello" {
+		t.Errorf("expected hello got %q", out)
+	}
+}
+
+func TestRotatingBuffer(t *testing.T) {
+	rb := NewRotatingBuffer(New)
+
+	first := rb.Current()
+	r1 := rb.NextReader()
+	defer r1.Close()
+	io.WriteString(first, "first")
+
+	old, next := rb.Rotate()
+	if old != first || next != rb.Current() || next == first {
+		t.Fatal("expected Rotate to swap in a new current buffer")
+	}
+	if _, err := io.WriteString(old, "late"); err != io.ErrClosedPipe {
+		t.Errorf("expected old buffer to be closed, got %v", err)
+	}
+
+	r2 := rb.NextReader()
+	defer r2.Close()
+	io.WriteString(next, "second")
+	next.Close()
+
+	if out, _ := ioutil.ReadAll(r1); string(out) != "first" {
+		t.Errorf("expected old reader to drain first, got %s", out)
+	}
+	if out, _ := ioutil.ReadAll(r2); string(out) != "second" {
+		t.Errorf("expected new reader to read second, got %s", out)
+	}
+}
+
+type syncWriter struct {
+	*writer
+	syncs int
+}
+
+func (w *syncWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	w := &syncWriter{writer: newWriter(nil)}
+	buf := NewBuffer(w)
+	io.WriteString(buf, "hello")
+	if err := buf.Sync(); err != nil || w.syncs != 1 {
+		t.Errorf("expected Sync to be forwarded once, got %d syncs, %v", w.syncs, err)
+	}
+
+	if err := New().Sync(); err != nil {
+		t.Errorf("expected Sync to be a no-op for memory writers, got %v", err)
+	}
+}
+
+func TestPeekCopy(t *testing.T) {
+	buf := NewCapped(10)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	io.WriteString(buf, "hel")
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		io.WriteString(buf, "lo")
+	}()
+
+	p, err := r.PeekCopy(5)
+	if err != nil || string(p) != "hello" {
+		t.Errorf("expected hello, nil got %s, %v", p, err)
+	}
+
+	io.CopyN(ioutil.Discard, r, 5)
+	io.WriteString(buf, "world")
+	if string(p) != "hello" {
+		t.Errorf("expected copy to be unaffected by reads and writes, got %s", p)
+	}
+
+	if p, err := r.PeekCopy(11); err != bufio.ErrBufferFull || string(p) != "world" {
+		t.Errorf("expected world, %v got %s, %v", bufio.ErrBufferFull, p, err)
+	}
+
+	buf.Close()
+	if p, err := r.PeekCopy(6); err != io.EOF || string(p) != "world" {
+		t.Errorf("expected world, %v got %s, %v", io.EOF, p, err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	buf := NewCapped(8)
+	io.WriteString(buf, "abcdef")
+	buf.Discard(4)
+	r := buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, "ghij") // wraps the ring after "efgh"
+
+	if p, err := r.Peek(4); err != nil || string(p) != "efgh" {
+		t.Errorf("expected efgh, nil got %q, %v", p, err)
+	}
+	if p, err := r.Peek(6); err != nil || string(p) != "efghij" { // copied across the wrap
+		t.Errorf("expected efghij, nil got %q, %v", p, err)
+	}
+	if c, _ := r.ReadByte(); c != 'e' {
+		t.Errorf("expected Peek not to advance the reader got %q", c)
+	}
+	r.UnreadByte()
+	if p, err := r.Peek(2); err != nil || string(p) != "ef" {
+		t.Errorf("expected the unread e in ef, nil got %q, %v", p, err)
+	}
+
+	buf.Close()
+	if p, err := r.Peek(7); err != io.EOF || string(p) != "efghij" {
+		t.Errorf("expected efghij, io.EOF got %q, %v", p, err)
+	}
+}
+
+func TestPeekReleasesRead(t *testing.T) {
+	buf := NewCapped(10)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	io.WriteString(buf, "0123456789")
+	io.CopyN(ioutil.Discard, r, 5)
+	go io.WriteString(buf, "abc") // only fits once the bytes r read are released
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if p, err := r.Peek(8); err != nil || string(p) != "56789abc" {
+			t.Errorf("expected 56789abc, nil got %q, %v", p, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		buf.Close()
+		t.Fatal("expected Peek not to deadlock with the writer")
+	}
+}
+
+func TestEmergencyUncap(t *testing.T) {
+	buf := NewCapped(5)
+	triggered := make(chan struct{}, 2)
+	buf.SetEmergencyUncap(50*time.Millisecond, func() { triggered <- struct{}{} })
+
+	r := buf.NextReader() // stalled reader
+	defer r.Close()
+
+	start := time.Now()
+	if _, err := io.WriteString(buf, "hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected write to block before uncapping, blocked %s", d)
+	}
+	select {
+	case <-triggered:
+	default:
+		t.Error("expected onTrigger to be called")
+	}
+	if buf.Len() != 11 {
+		t.Errorf("expected buffer to grow past its cap, got len %d", buf.Len())
+	}
+
+	p := make([]byte, 11)
+	r.Read(p)
+	go r.Read(p) // evicts the first write, then reads part of the next one
+	<-time.After(20 * time.Millisecond)
+
+	start = time.Now()
+	io.WriteString(buf, "hello world")
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected cap to be enforced once drained, blocked %s", d)
+	}
+}
+
+func TestReaderGroup(t *testing.T) {
+	buf := New()
+	g := buf.NewReaderGroup()
+	defer g.Close()
+
+	var mu sync.Mutex
+	var grp sync.WaitGroup
+	seen := make(map[byte]int)
+	for i := 0; i < 4; i++ {
+		grp.Add(1)
+		go func(r io.ReadCloser, size int) {
+			defer grp.Done()
+			defer r.Close()
+			p := make([]byte, size)
+			for {
+				n, err := r.Read(p)
+				mu.Lock()
+				for _, c := range p[:n] {
+					seen[c]++
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}(g.NextReader(), i+1)
+	}
+
+	for i := 0; i < 256; i += 16 {
+		var p []byte
+		for c := i; c < i+16; c++ {
+			p = append(p, byte(c))
+		}
+		buf.Write(p)
+	}
+	buf.Close()
+	grp.Wait()
+
+	if len(seen) != 256 {
+		t.Errorf("expected all 256 bytes to be read, got %d", len(seen))
+	}
+	for c, n := range seen {
+		if n != 1 {
+			t.Errorf("expected %d to be read once, read %d times", c, n)
+		}
+	}
+}
+
+func TestSyncReader(t *testing.T) {
+	buf := New()
+	r := buf.NextSyncReader()
+	defer r.Close()
+
+	var mu sync.Mutex
+	var grp sync.WaitGroup
+	seen := make(map[byte]int)
+	for i := 0; i < 4; i++ {
+		grp.Add(1)
+		go func(size int) {
+			defer grp.Done()
+			p := make([]byte, size)
+			for {
+				n, err := r.Read(p)
+				mu.Lock()
+				for _, c := range p[:n] {
+					seen[c]++
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}(i + 1)
+	}
+
+	for i := 0; i < 256; i += 16 {
+		var p []byte
+		for c := i; c < i+16; c++ {
+			p = append(p, byte(c))
+		}
+		buf.Write(p)
+	}
+	buf.Close()
+	grp.Wait()
+
+	if len(seen) != 256 {
+		t.Errorf("expected all 256 bytes to be read, got %d", len(seen))
+	}
+	for c, n := range seen {
+		if n != 1 {
+			t.Errorf("expected %d to be read once, read %d times", c, n)
+		}
+	}
+}
+
+func TestSyncReaderCloseWhileReading(t *testing.T) {
+	buf := New()
+	defer buf.Close()
+	r := buf.NextSyncReader()
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let Read block
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close not to wait for the blocked Read")
+	}
+	if err := <-done; err != io.EOF {
+		t.Errorf("expected the blocked Read to return io.EOF got %v", err)
+	}
+	assertNumReaders(0, buf, t)
+}
+func TestWriteString(t *testing.T) {
+	buf := NewCapped(4)
+	r := buf.NextReader()
+	defer r.Close()
+	go func() {
+		buf.WriteString("hello world") // chunked against the cap
+		buf.Close()
+	}()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "hello world" {
+		t.Errorf("expected hello world, nil got %q, %v", data, err)
+	}
+
+	buf = NewBuffer(NewMemoryWriter(make([]byte, 0, 64)))
+	s, p := "hello", []byte("hello")
+	write := testing.AllocsPerRun(100, func() {
+		buf.Write(p)
+		buf.Discard(5)
+	})
+	writeString := testing.AllocsPerRun(100, func() {
+		buf.WriteString(s)
+		buf.Discard(5)
+	})
+	if writeString > write {
+		t.Errorf("expected WriteString to allocate no more than Write got %v and %v", writeString, write)
+	}
+}
+
+func TestBufferReadFrom(t *testing.T) {
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 100*1024))
+	buf := NewCapped(1024)
+	r := buf.NextReader()
+	read := make(chan []byte)
+	go func() {
+		got, _ := ioutil.ReadAll(r)
+		read <- got
+	}()
+	if n, err := buf.ReadFrom(bytes.NewReader(data)); n != int64(len(data)) || err != nil {
+		t.Errorf("expected %d, nil got %d, %v", len(data), n, err)
+	}
+	buf.Close()
+	if got := <-read; !bytes.Equal(got, data) {
+		t.Errorf("expected to read all %d bytes got %d", len(data), len(got))
+	}
+
+	buf = NewCapped(4)
+	stalled := buf.NextReader()
+	defer stalled.Close()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		buf.Close()
+	}()
+	if n, err := buf.ReadFrom(strings.NewReader("hello world")); n != 4 || err != io.ErrClosedPipe {
+		t.Errorf("expected 4, io.ErrClosedPipe when closed mid-copy got %d, %v", n, err)
+	}
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+	go func() {
+		for _, s := range []string{"hello", " ", "world"} {
+			io.WriteString(buf, s)
+			time.Sleep(5 * time.Millisecond)
+		}
+		buf.Close()
+	}()
+	if c, _ := r.ReadByte(); c != 'h' {
+		t.Errorf("expected h got %q", c)
+	}
+	r.UnreadByte()
+
+	var dst bytes.Buffer
+	if n, err := io.Copy(&dst, r); n != 11 || err != nil || dst.String() != "hello world" {
+		t.Errorf("expected 11, nil, hello world got %d, %v, %q", n, err, dst.String())
+	}
+
+	buf = New()
+	r = buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, "hello")
+	if n, err := r.WriteTo(&fakeFlusher{err: io.ErrClosedPipe}); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("expected 0, io.ErrClosedPipe from the failing writer got %d, %v", n, err)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	buf := New()
+	g := buf.NewReaderGroup()
+	defer g.Close()
+	a, b := g.NextReader(), g.NextReader()
+
+	io.WriteString(buf, "job1")
+	p := make([]byte, 4)
+	if _, err := io.ReadFull(a, p); err != nil || string(p) != "job1" {
+		t.Fatalf("expected job1, nil got %q, %v", p, err)
+	}
+	a.Close() // failed to process it
+	if n, err := buf.Requeue(p); n != 4 || err != nil {
+		t.Errorf("expected 4, nil got %d, %v", n, err)
+	}
+	if _, err := io.ReadFull(b, p); err != nil || string(p) != "job1" {
+		t.Errorf("expected the requeued job1, nil got %q, %v", p, err)
+	}
+}
+
+func TestReaderLen(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	io.WriteString(buf, "hello")
+	p := make([]byte, 2)
+	io.ReadFull(r, p) // takes a snapshot of hello
+	io.WriteString(buf, "world")
+	if l := r.Len(); l != 8 {
+		t.Errorf("expected 8 unread bytes got %d", l)
+	}
+	r.ReadByte()
+	r.UnreadByte()
+	if l := r.Len(); l != 8 {
+		t.Errorf("expected 8 unread bytes after an unread got %d", l)
+	}
+	r.Close()
+	if l := r.Len(); l != 0 {
+		t.Errorf("expected 0 for a closed reader got %d", l)
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	buf := New()
+	r := buf.NextReader()
+	defer r.Close()
+	io.WriteString(buf, "partial")
+	upstream := errors.New("upstream failed")
+	buf.CloseWithError(upstream)
+	buf.CloseWithError(errors.New("ignored")) // only the first close sets the error
+
+	if data, err := ioutil.ReadAll(r); err != upstream || string(data) != "partial" {
+		t.Errorf("expected partial, upstream failed got %q, %v", data, err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != upstream {
+		t.Errorf("expected every later read to return the error got %d, %v", n, err)
+	}
+	if _, err := io.WriteString(buf, "more"); err != upstream {
+		t.Errorf("expected writes to return the error got %v", err)
+	}
+}
+
+func TestBufferWait(t *testing.T) {
+	buf := New()
+	r := buf.NextReader()
+	io.WriteString(buf, "hello")
+	buf.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := buf.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to time out while the reader drains got %v", err)
+	}
+
+	go func() {
+		ioutil.ReadAll(r)
+		r.Close()
+	}()
+	if err := buf.Wait(context.Background()); err != nil {
+		t.Errorf("expected nil after a clean close got %v", err)
+	}
+
+	bctx, bcancel := context.WithCancel(context.Background())
+	buf = NewWithContext(bctx)
+	go bcancel()
+	if err := buf.Wait(context.Background()); err != context.Canceled {
+		t.Errorf("expected the close error context.Canceled got %v", err)
+	}
+}
+
+func TestNewWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	buf := NewCappedBufferWithContext(ctx, NewMemoryWriter(nil), 2)
+	r := buf.NextReader()
+	defer r.Close()
+
+	wrote := make(chan error)
+	go func() {
+		_, err := io.WriteString(buf, "hello")
+		wrote <- err
+	}()
+
+	read := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(buf.NextReaderFromNow())
+		read <- err
+	}()
+
+	<-time.After(50 * time.Millisecond)
+	cancel()
+
+	for _, ch := range []chan error{wrote, read} {
+		select {
+		case err := <-ch:
+			if err != context.Canceled {
+				t.Errorf("expected %v got %v", context.Canceled, err)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Error("expected cancel to unblock reader and writer")
+		}
+	}
+
+	if out, err := ioutil.ReadAll(r); string(out) != "he" || err != context.Canceled {
+		t.Errorf("expected he, %v got %s, %v", context.Canceled, out, err)
+	}
+}
+
+func TestNetstring(t *testing.T) {
+	// a small ring, so frames wrap around it
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 8)), 8)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	msgs := []string{"hello", "", "hello world", "12345678901234"}
+	go func() {
+		for _, msg := range msgs {
+			if _, err := buf.WriteNetstring([]byte(msg)); err != nil {
+				t.Error(err)
+			}
+		}
+		io.WriteString(buf, "3:abc")
+		buf.Close()
+	}()
+
+	for _, expect := range msgs {
+		if p, err := r.ReadNetstring(); err != nil || string(p) != expect {
+			t.Errorf("expected %s, nil got %s, %v", expect, p, err)
+		}
+	}
+	if _, err := r.ReadNetstring(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v got %v", io.ErrUnexpectedEOF, err)
+	}
+	if _, err := r.ReadNetstring(); err != io.EOF {
+		t.Errorf("expected %v got %v", io.EOF, err)
+	}
+
+	for _, bad := range []string{"a:b,", "01:a,", ":,", "1:ab", "1234567890:"} {
+		buf := New()
+		r := buf.NextBufferReader()
+		io.WriteString(buf, bad)
+		buf.Close()
+		if _, err := r.ReadNetstring(); err != ErrMalformedNetstring {
+			t.Errorf("%q: expected %v got %v", bad, ErrMalformedNetstring, err)
+		}
+	}
+
+	buf = New()
+	r = buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, "999999999:")
+	if _, err := r.ReadNetstring(); err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge got %v", err)
+	}
+	r.SetMaxNetstring(4)
+	buf.WriteNetstring([]byte("hello"))
+	if _, err := r.ReadNetstring(); err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge got %v", err)
+	}
+	if p, _ := r.Peek(6); string(p) != "hello," {
+		t.Errorf("expected the netstring's data to be left unread got %q", p)
+	}
+}
+
+func TestMaxLag(t *testing.T) {
+	buf := New()
+	buf.SetMaxLag(10)
+
+	stalled := buf.NextBufferReader()
+	defer stalled.Close()
+
+	fetched := buf.NextBufferReader() // holds a snapshot of the first write
+	defer fetched.Close()
+
+	io.WriteString(buf, "hello")
+	p := make([]byte, 2)
+	io.ReadFull(fetched, p)
+
+	io.WriteString(buf, "abcdefghij")
+	io.WriteString(buf, "klmnopqrst")
+	if buf.Len() != 10 {
+		t.Errorf("expected lagging readers to be advanced, got len %d", buf.Len())
+	}
+
+	buf.Close()
+	if out, _ := ioutil.ReadAll(stalled); string(out) != "klmnopqrst" || stalled.Dropped() != 15 {
+		t.Errorf("expected klmnopqrst after dropping 15 bytes, got %s after %d", out, stalled.Dropped())
+	}
+	if out, _ := ioutil.ReadAll(fetched); string(out) != "lloklmnopqrst" || fetched.Dropped() != 10 {
+		t.Errorf("expected lloklmnopqrst after dropping 10 bytes, got %s after %d", out, fetched.Dropped())
+	}
+}
+
+func TestProtectReader(t *testing.T) {
+	buf := New()
+	buf.SetMaxLag(10)
+
+	protected := buf.NextBufferReader()
+	defer protected.Close()
+	protected.Protect()
+	victim := buf.NextBufferReader()
+	defer victim.Close()
+
+	io.WriteString(buf, "abcdefghij")
+	io.WriteString(buf, "klmno")
+	if victim.Dropped() != 5 || protected.Dropped() != 0 {
+		t.Errorf("expected only the unprotected reader to drop 5 bytes got %d and %d", victim.Dropped(), protected.Dropped())
+	}
+	if buf.Len() != 15 {
+		t.Errorf("expected the protected reader to hold all 15 bytes got len %d", buf.Len())
+	}
+
+	protected.Unprotect()
+	if protected.Dropped() != 5 || buf.Len() != 10 {
+		t.Errorf("expected unprotecting to advance the reader past 5 bytes got %d dropped and len %d", protected.Dropped(), buf.Len())
+	}
+}
+
+func TestRecordSize(t *testing.T) {
+	buf := New()
+	buf.RecordSize(4)
+	r := buf.NextReader()
+	defer r.Close()
+
+	go func() {
+		for _, chunk := range []string{"abc", "def", "ghi", "jkl", "mn"} {
+			<-time.After(10 * time.Millisecond)
+			io.WriteString(buf, chunk) // records span writes
+		}
+		buf.Close()
+	}()
+
+	if _, err := r.Read(make([]byte, 3)); err != io.ErrShortBuffer {
+		t.Errorf("expected %v got %v", io.ErrShortBuffer, err)
+	}
+
+	var out []byte
+	p := make([]byte, 6)
+	for {
+		n, err := r.Read(p)
+		out = append(out, p[:n]...)
+		if err == io.EOF {
+			if n != 2 {
+				t.Errorf("expected final partial record of 2 bytes, got %d", n)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if n != 4 {
+			t.Errorf("expected a single whole record, got %d bytes", n)
+		}
+	}
+	if string(out) != "abcdefghijklmn" {
+		t.Errorf("expected abcdefghijklmn got %s", out)
+	}
+}
+
+func TestBufferDiscard(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello")
+	if n, err := buf.Discard(2); n != 2 || err != nil || buf.Len() != 3 {
+		t.Errorf("expected 2, nil with len 3 got %d, %v with len %d", n, err, buf.Len())
+	}
+
+	buf.Keep(100) // readers won't evict anything, Discard ignores keep
+	slow, fast := buf.NextReader(), buf.NextReader()
+	defer slow.Close()
+	defer fast.Close()
+
+	io.WriteString(buf, " world")
+	io.ReadFull(fast, make([]byte, 9))
+	io.ReadFull(slow, make([]byte, 2))
+
+	if n, err := buf.Discard(100); n != 0 || err != nil {
+		t.Errorf("expected slowest reader to prevent discard, got %d, %v", n, err)
+	}
+
+	io.ReadFull(slow, make([]byte, 7))
+	if n, err := buf.Discard(100); n != 3 || err != nil {
+		t.Errorf("expected 3, nil got %d, %v", n, err)
+	}
+	if buf.Len() != 6 {
+		t.Errorf("expected len 6 got %d", buf.Len())
+	}
+}
+
+func TestIsLastReader(t *testing.T) {
+	buf := New()
+	r1 := buf.NextBufferReader()
+	if !r1.IsLastReader() {
+		t.Error("expected sole reader to be the last reader")
+	}
+
+	r2 := buf.NextBufferReaderFromNow()
+	if r1.IsLastReader() || r2.IsLastReader() {
+		t.Error("expected neither of two readers to be the last reader")
+	}
+
+	r1.Close()
+	if r1.IsLastReader() || !r2.IsLastReader() {
+		t.Error("expected remaining reader to be the last reader")
+	}
+
+	r2.Close()
+	if r2.IsLastReader() {
+		t.Error("expected closed reader not to be the last reader")
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	buf := New()
+	e := buf.Endpoint()
+	io.WriteString(e, "hello")
+
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(e, p); err != nil || string(p) != "hello" {
+		t.Errorf("expected hello, nil got %s, %v", p, err)
+	}
+
+	e.Close()
+	if _, err := io.WriteString(buf, "closed"); err != io.ErrClosedPipe {
+		t.Errorf("expected closing the endpoint to close the buffer, got %v", err)
+	}
+	if n, err := e.Read(p); n != 0 || err != io.EOF {
+		t.Errorf("expected 0, %v got %d, %v", io.EOF, n, err)
+	}
+	assertNumReaders(0, buf, t)
+}
+
+func TestEmergencyUncapClock(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Now()
+	buf := NewCapped(5)
+	buf.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	buf.SetEmergencyUncap(20*time.Millisecond, nil)
+	r := buf.NextReader() // stalled reader
+	defer r.Close()
+
+	wrote := make(chan error)
+	go func() {
+		_, err := io.WriteString(buf, "hello world")
+		wrote <- err
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("expected the write to block while the clock stands still")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Lock()
+	now = now.Add(20 * time.Millisecond)
+	mu.Unlock()
+	select {
+	case err := <-wrote:
+		if err != nil {
+			t.Errorf("expected the uncapped write to succeed got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the write to be uncapped once the clock passed after")
+	}
+}
+
+func TestThroughputStats(t *testing.T) {
+	buf := New()
+	now := time.Now()
+	buf.now = func() time.Time { return now }
+
+	data := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		buf.Write(data)
+		buf.Discard(500)
+		now = now.Add(100 * time.Millisecond)
+	}
+
+	w, rd := buf.ThroughputStats()
+	if w < 9500 || w > 10500 {
+		t.Errorf("expected write rate of ~10000 B/s, got %f", w)
+	}
+	if rd < 4500 || rd > 5500 {
+		t.Errorf("expected read rate of ~5000 B/s, got %f", rd)
+	}
+}
+
+func TestNextReaderUpTo(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello")
+	barrier := buf.Barrier()
+	if barrier != 5 {
+		t.Errorf("expected barrier at 5 got %d", barrier)
+	}
+
+	r := buf.NextReaderUpTo(barrier)
+	defer r.Close()
+	io.WriteString(buf, " world")
+
+	out, err := ioutil.ReadAll(r) // doesn't need the buffer to be closed
+	if err != nil || string(out) != "hello" {
+		t.Errorf("expected hello, nil got %s, %v", out, err)
+	}
+}
+
+func TestNextReaderUpToAdvanced(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello")
+	r := buf.NextReaderUpTo(buf.Barrier())
+	defer r.Close()
+
+	buf.SetMaxLag(4)
+	io.WriteString(buf, "abcdefgh") // advances r past the barrier to 9, after the hello it was handed
+	out, err := ioutil.ReadAll(r)
+	if err != nil || string(out) != "hello" {
+		t.Errorf("expected hello, nil and nothing past the barrier got %s, %v", out, err)
+	}
+
+	buf = New()
+	r = buf.NextReaderUpTo(5)
+	defer r.Close()
+	buf.SetMaxLag(4)
+	io.WriteString(buf, "helloabcdefgh") // advances r past the barrier to 9, before it read anything
+	buf.Close()
+	out, err = ioutil.ReadAll(r)
+	if err != nil || len(out) != 0 {
+		t.Errorf("expected nothing past the barrier got %s, %v", out, err)
+	}
+}
+
+func TestBarrierCompleteWritesOnly(t *testing.T) {
+	buf := NewCapped(8)
+	buf.CompleteWritesOnly()
+	r := buf.NextReader()
+	defer r.Close()
+	io.WriteString(buf, "hi")
+	go io.WriteString(buf, "complete") // blocks on the cap part way through
+	time.Sleep(10 * time.Millisecond)
+
+	if barrier := buf.Barrier(); barrier != 2 {
+		t.Errorf("expected the barrier before the incomplete write at 2 got %d", barrier)
+	}
+	buf.Close()
+}
+
+func TestNextReaderUpToCopy(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello")
+	r := buf.NextReaderUpTo(buf.Barrier())
+	defer r.Close()
+	io.WriteString(buf, " world")
+	if _, ok := r.(io.Seeker); ok {
+		t.Errorf("expected the limited reader not to bypass its barrier with Seek")
+	}
+
+	var out bytes.Buffer
+	if n, err := io.Copy(&out, r); n != 5 || err != nil || out.String() != "hello" {
+		t.Errorf("expected 5, nil, hello got %d, %v, %q", n, err, out.String())
+	}
+}
+
+func TestNextReaders(t *testing.T) {
+	buf := New()
+	first := buf.NextReader()
+	io.WriteString(buf, "hello")
+	first.Read(make([]byte, 5))
+
+	rs := buf.NextReaders(10)
+	assertNumReaders(11, buf, t)
+	first.Close()
+
+	io.WriteString(buf, " world")
+	buf.Close()
+	for _, r := range rs {
+		if out, _ := ioutil.ReadAll(r); string(out) != "hello world" {
+			t.Errorf("expected hello world got %s", out)
+		}
+		r.Close()
+	}
+	assertNumReaders(0, buf, t)
+}
+
+func TestBytesRead(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello")
+	r := buf.NextBufferReaderFromNow()
+	defer r.Close()
+
+	io.WriteString(buf, "hello world")
+	p := make([]byte, 3)
+	r.Read(p)
+	r.Read(p)
+	r.Discard(2)
+	if n := r.BytesRead(); n != 8 {
+		t.Errorf("expected 8 bytes read, got %d", n)
+	}
+
+	buf.Close()
+	io.Copy(ioutil.Discard, r)
+	if n := r.BytesRead(); n != 11 {
+		t.Errorf("expected 11 bytes read, got %d", n)
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	buf := New()
+	var recovered []interface{}
+	buf.SetPanicHandler(func(rec interface{}) { recovered = append(recovered, rec) })
+	buf.OnLastReaderClose(func() error { panic("close") })
+	buf.SetEventHook(func(ev Event) {
+		if ev.Kind == ReaderJoined {
+			panic("join")
+		}
+	})
+
+	r := buf.NextReader()
+	r.Close()
+	if len(recovered) != 2 || recovered[0] != "join" || recovered[1] != "close" {
+		t.Errorf("expected join and close panics to be handled, got %v", recovered)
+	}
+
+	r = buf.NextReader()
+	io.WriteString(buf, "hello")
+	buf.Close()
+	if out, _ := ioutil.ReadAll(r); string(out) != "hello" {
+		t.Errorf("expected buffer to remain usable, got %s", out)
+	}
+}
+
+func TestCopyBufferTo(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 8)), 8)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	go func() {
+		io.WriteString(buf, "hello world, ") // wraps the ring
+		io.WriteString(buf, "this is a test")
+		buf.Close()
+	}()
+
+	var out bytes.Buffer
+	n, err := r.CopyBufferTo(writerOnly{&out}, nil)
+	if err != nil || n != 27 || out.String() != "hello world, this is a test" {
+		t.Errorf("expected 27, nil got %d, %v: %s", n, err, out.String())
+	}
+}
+
+func TestCompleteWritesOnly(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 16)), 16)
+	buf.CompleteWritesOnly()
+	r := buf.NextReader()
+	defer r.Close()
+
+	if _, err := buf.Write(make([]byte, 17)); err != ErrWriteTooLarge {
+		t.Errorf("expected ErrWriteTooLarge got %v", err)
+	}
+
+	ends := make(map[int]bool)
+	total := 0
+	for i := 1; i <= 200; i++ {
+		total += i%16 + 1
+		ends[total] = true
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 200; i++ {
+			buf.Write(bytes.Repeat([]byte{byte(i)}, i%16+1))
+		}
+		buf.Close()
+	}()
+
+	p := make([]byte, 32)
+	read := 0
+	for {
+		n, err := r.Read(p)
+		if read += n; n > 0 && !ends[read] {
+			t.Fatalf("read ended inside a write at offset %d", read)
+		}
+		if err != nil {
+			break
+		}
+	}
+	wg.Wait()
+	if read != total {
+		t.Errorf("expected to read %d bytes got %d", total, read)
+	}
+}
+
+func TestReaderGate(t *testing.T) {
+	buf := New()
+	errShutdown := errors.New("shutting down")
+	var closing int32
+	buf.SetReaderGate(func() error {
+		if atomic.LoadInt32(&closing) == 1 {
+			return errShutdown
+		}
+		return nil
+	})
+
+	r, err := buf.NextReaderChecked()
+	if err != nil || r == nil {
+		t.Fatalf("expected a reader got %v, %v", r, err)
+	}
+	io.WriteString(buf, "hello")
+	cps := buf.ReaderManifest()
+
+	atomic.StoreInt32(&closing, 1)
+	if r, err := buf.NextReaderChecked(); err != errShutdown || r != nil {
+		t.Errorf("expected nil, errShutdown got %v, %v", r, err)
+	}
+	if r, err := buf.NextReaderFromNowChecked(); err != errShutdown || r != nil {
+		t.Errorf("expected nil, errShutdown got %v, %v", r, err)
+	}
+	if rs, err := buf.RestoreReaders(cps); rs[0] != nil || err == nil || err.(RestoreError)[0] != errShutdown {
+		t.Errorf("expected nil, errShutdown got %v, %v", rs[0], err)
+	}
+	if r, _, err := buf.NextReaderReplayFrom(2, 0); err != errShutdown || r != nil {
+		t.Errorf("expected nil, errShutdown got %v, %v", r, err)
+	}
+	assertNumReaders(1, buf, t)
+
+	atomic.StoreInt32(&closing, 0)
+	r.Close()
+	if r, err := buf.NextReaderFromNowChecked(); err != nil || r == nil {
+		t.Errorf("expected a reader got %v, %v", r, err)
+	}
+	assertNumReaders(1, buf, t)
+}
+
+func TestLastReaderClosed(t *testing.T) {
+	buf := New()
+	done := buf.LastReaderClosed()
+	a, b := buf.NextReader(), buf.NextReader()
+
+	a.Close()
+	select {
+	case <-done:
+		t.Fatal("expected the channel to stay open while a reader is open")
+	default:
+	}
+	b.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the channel to close with the last reader")
+	}
+
+	select {
+	case <-buf.LastReaderClosed(): // already fired
+	default:
+		t.Error("expected a channel requested afterwards to be closed")
+	}
+	buf.NextReader().Close() // doesn't close it twice
+}
+
+func TestMaxReaders(t *testing.T) {
+	buf := New()
+	buf.SetMaxReaders(2)
+	a := buf.NextReader() // counts, but isn't refused
+	b, err := buf.NextReaderChecked()
+	if err != nil || b == nil {
+		t.Fatalf("expected a reader got %v, %v", b, err)
+	}
+	if r, err := buf.NextReaderChecked(); err != ErrTooManyReaders || r != nil {
+		t.Errorf("expected nil, ErrTooManyReaders got %v, %v", r, err)
+	}
+	if r, err := buf.NextReaderFromNowChecked(); err != ErrTooManyReaders || r != nil {
+		t.Errorf("expected nil, ErrTooManyReaders got %v, %v", r, err)
+	}
+	assertNumReaders(2, buf, t)
+
+	a.Close()
+	if r, err := buf.NextReaderFromNowChecked(); err != nil || r == nil {
+		t.Errorf("expected a reader after one closed got %v, %v", r, err)
+	}
+	buf.SetMaxReaders(0)
+	if r, err := buf.NextReaderChecked(); err != nil || r == nil {
+		t.Errorf("expected a reader without a limit got %v, %v", r, err)
+	}
+	assertNumReaders(3, buf, t)
+}
+
+func TestReaderDone(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	done := r.Done()
+
+	select {
+	case <-done:
+		t.Fatal("expected Done to be open before Close")
+	default:
+	}
+	if r.Closed() {
+		t.Error("expected Closed to be false before Close")
+	}
+
+	r.Close()
+	r.Close() // double close must not close Done twice
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Done to be closed after Close")
+	}
+	if !r.Closed() {
+		t.Error("expected Closed to be true after Close")
+	}
+
+	r = buf.NextBufferReader()
+	r.Close()
+	<-r.Done() // Done called after Close is already closed
+}
+
+func TestDumpTo(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 8)), 8)
+	io.WriteString(buf, "hello")
+	buf.Discard(4)
+	io.WriteString(buf, " world") // wraps the ring
+
+	var out bytes.Buffer
+	if n, err := buf.DumpTo(&out); err != nil || n != 7 || out.String() != "o world" {
+		t.Errorf("expected 7, nil got %d, %v: %q", n, err, out.String())
+	}
+	if buf.Len() != 7 {
+		t.Errorf("expected DumpTo not to consume, got len %d", buf.Len())
+	}
+
+	out.Reset()
+	if n, err := New().DumpTo(&out); err != nil || n != 0 {
+		t.Errorf("expected 0, nil got %d, %v", n, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 8)), 8)
+	io.WriteString(buf, "hello")
+	buf.Discard(4)
+	io.WriteString(buf, " world") // wraps the ring
+
+	p, err := buf.Snapshot()
+	if err != nil || string(p) != "o world" {
+		t.Errorf("expected o world, nil got %q, %v", p, err)
+	}
+	p[0] = 'x'
+	if q, _ := buf.Snapshot(); string(q) != "o world" {
+		t.Errorf("expected the snapshot to be a copy got %q", q)
+	}
+	assertNumReaders(0, buf, t)
+	if buf.Len() != 7 {
+		t.Errorf("expected Snapshot not to consume, got len %d", buf.Len())
+	}
+}
+
+func TestWriteFrom(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 16)), 16)
+	buf.MessageBoundaries()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	const producers, writes = 4, 50
+	var wg sync.WaitGroup
+	for id := 1; id <= producers; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				buf.WriteFrom(id, bytes.Repeat([]byte{byte(id)}, 5+i%20))
+			}
+		}(id)
+	}
+	go func() {
+		wg.Wait()
+		buf.Close()
+	}()
+
+	got := make(map[int]int)
+	for {
+		msg, id, err := r.ReadMessageFrom()
+		if err != nil {
+			break
+		}
+		if len(msg) == 0 || !bytes.Equal(msg, bytes.Repeat([]byte{byte(id)}, len(msg))) {
+			t.Fatalf("message from %d has bytes from another producer: %v", id, msg)
+		}
+		got[id] += len(msg)
+	}
+
+	for id := 1; id <= producers; id++ {
+		if want := writes*5 + (writes/20)*190 + 45; got[id] != want {
+			t.Errorf("expected %d bytes from %d got %d", want, id, got[id])
+		}
+	}
+}
+
+func TestMaxReaderAge(t *testing.T) {
+	buf := New()
+	var mu sync.Mutex
+	var expired []Event
+	buf.SetEventHook(func(ev Event) {
+		if ev.Kind == ReaderExpired {
+			mu.Lock()
+			expired = append(expired, ev)
+			mu.Unlock()
+		}
+	})
+
+	stuck := buf.NextBufferReader()
+	defer stuck.Close()
+	io.WriteString(buf, "hello")
+	buf.SetMaxReaderAge(20 * time.Millisecond)
+	defer buf.SetMaxReaderAge(0)
+
+	deadline := time.Now().Add(time.Second)
+	for stuck.Dropped() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if d := stuck.Dropped(); d != 5 {
+		t.Errorf("expected the stuck reader to drop 5 bytes got %d", d)
+	}
+	if l := buf.Len(); l != 0 {
+		t.Errorf("expected the dropped bytes to be evicted got len %d", l)
+	}
+	mu.Lock()
+	if len(expired) != 1 || expired[0].N != 5 {
+		t.Errorf("expected one ReaderExpired event for 5 bytes got %v", expired)
+	}
+	mu.Unlock()
+
+	io.WriteString(buf, "world")
+	p := make([]byte, 5)
+	if n, err := stuck.Read(p); err != nil || string(p[:n]) != "world" {
+		t.Errorf("expected world, nil got %q, %v", p[:n], err)
+	}
+}
+
+func TestMaxReaderAgeSlowSnapshot(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+	data := strings.Repeat("x", 20)
+	io.WriteString(buf, data)
+	p := make([]byte, 1)
+	r.Read(p)                    // r's snapshot holds all 20 bytes
+	io.WriteString(buf, "hello") // past r's snapshot, so r isn't caught up
+	buf.SetMaxReaderAge(20 * time.Millisecond)
+	defer buf.SetMaxReaderAge(0)
+
+	for i := 1; i < len(data); i++ { // reading takes far longer than the max age, but r never stops reading
+		time.Sleep(5 * time.Millisecond)
+		if n, err := r.Read(p); n != 1 || err != nil {
+			t.Fatalf("expected 1, nil got %d, %v", n, err)
+		}
+	}
+	if d := r.Dropped(); d != 0 {
+		t.Errorf("expected the reading reader not to be expired got %d dropped", d)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	buf := NewCapped(4)
+	r := buf.NextReader()
+	defer r.Close()
+
+	n, err := buf.WriteDeadline([]byte("hello world"), time.Now().Add(20*time.Millisecond))
+	if n != 4 || err != ErrWriteTimeout {
+		t.Errorf("expected 4, ErrWriteTimeout got %d, %v", n, err)
+	}
+
+	p := make([]byte, 4)
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "hell" {
+		t.Errorf("expected hell, nil got %q, %v", p[:n], err)
+	}
+	go r.Read(p) // frees the space read so far
+	if n, err := buf.WriteDeadline([]byte("o wo"), time.Now().Add(time.Second)); n != 4 || err != nil {
+		t.Errorf("expected 4, nil got %d, %v", n, err)
+	}
+}
+
+func TestAppendTo(t *testing.T) {
+	buf := NewCapped(8)
+	io.WriteString(buf, "hello")
+	buf.Discard(3)
+	r := buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, "world") // wraps the ring
+
+	var dst bytes.Buffer
+	dst.WriteString(">")
+	if n, err := r.AppendTo(&dst, 4); n != 4 || err != nil || dst.String() != ">lowo" {
+		t.Errorf("expected 4, nil, >lowo got %d, %v, %q", n, err, dst.String())
+	}
+	if n, err := r.AppendTo(&dst, 0); n != 3 || err != nil || dst.String() != ">loworld" {
+		t.Errorf("expected 3, nil, >loworld got %d, %v, %q", n, err, dst.String())
+	}
+	buf.Close()
+	if n, err := r.AppendTo(&dst, 0); n != 0 || err != io.EOF {
+		t.Errorf("expected 0, io.EOF got %d, %v", n, err)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	buf := NewCapped(4)
+	r := buf.NextReader()
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if n, err := buf.WriteContext(ctx, []byte("hello world")); n != 4 || err != context.Canceled {
+		t.Errorf("expected 4, context.Canceled got %d, %v", n, err)
+	}
+
+	p := make([]byte, 4)
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "hell" {
+		t.Errorf("expected hell, nil got %q, %v", p[:n], err)
+	}
+	go r.Read(p) // frees the space read so far
+	if n, err := buf.WriteContext(context.Background(), []byte("o wo")); n != 4 || err != nil {
+		t.Errorf("expected 4, nil got %d, %v", n, err)
+	}
+}
+
+func TestWriteContextWaits(t *testing.T) {
+	buf := New()
+	buf.WaitForInitialReaders(1, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if n, err := buf.WriteContext(ctx, []byte("hello")); n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("expected 0, context.DeadlineExceeded waiting for readers got %d, %v", n, err)
+	}
+
+	r := buf.NextReader()
+	defer r.Close()
+	buf.Pause()
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if n, err := buf.WriteContext(ctx, []byte("hello")); n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("expected 0, context.DeadlineExceeded while paused got %d, %v", n, err)
+	}
+	if n, err := buf.WriteDeadline([]byte("hello"), time.Now().Add(20*time.Millisecond)); n != 0 || err != ErrWriteTimeout {
+		t.Errorf("expected 0, ErrWriteTimeout while paused got %d, %v", n, err)
+	}
+
+	buf.Resume()
+	if n, err := buf.WriteContext(context.Background(), []byte("hello")); n != 5 || err != nil {
+		t.Errorf("expected 5, nil after resuming got %d, %v", n, err)
+	}
+}
+
+func TestSetCap(t *testing.T) {
+	buf := NewCapped(4)
+	r := buf.NextReader()
+	defer r.Close()
+
+	wrote := make(chan error)
+	go func() {
+		_, err := io.WriteString(buf, "hello world")
+		wrote <- err
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("expected the write to block on the cap")
+	case <-time.After(10 * time.Millisecond):
+	}
+	buf.SetCap(16)
+	if err := <-wrote; err != nil || buf.Cap() != 16 {
+		t.Errorf("expected the raised cap to unblock the write got %v with cap %d", err, buf.Cap())
+	}
+
+	buf.SetCap(2) // below the 11 buffered bytes
+	go func() {
+		_, err := io.WriteString(buf, "!")
+		wrote <- err
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("expected the write to block until the buffer drains below the cap")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p := make([]byte, 11)
+	if _, err := io.ReadFull(r, p); err != nil || string(p) != "hello world" {
+		t.Errorf("expected nothing to be dropped got %q, %v", p, err)
+	}
+	go r.Read(p) // evicts what was read
+	if err := <-wrote; err != nil {
+		t.Errorf("expected the write to finish once drained got %v", err)
+	}
+
+	buf.SetCap(0)
+	if n, err := buf.Write(make([]byte, 100)); n != 100 || err != nil || buf.Cap() != 0 {
+		t.Errorf("expected an uncapped write got %d, %v with cap %d", n, err, buf.Cap())
+	}
+}
+
+func TestPauseWrites(t *testing.T) {
+	buf := NewCapped(4)
+	r := buf.NextReader()
+	defer r.Close()
+
+	buf.Pause()
+	wrote := make(chan error)
+	go func() {
+		_, err := io.WriteString(buf, "hello")
+		wrote <- err
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("expected the write to block while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	buf.Resume()
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(r, p); err != nil || string(p) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", p, err)
+	}
+	if err := <-wrote; err != nil {
+		t.Errorf("expected the write to finish after Resume got %v", err)
+	}
+
+	buf.PauseBlocksWrites(false)
+	buf.Pause()
+	if n, err := io.WriteString(buf, "x"); n != 0 || err != ErrPaused {
+		t.Errorf("expected 0, ErrPaused got %d, %v", n, err)
+	}
+	buf.Resume()
+	if n, err := io.WriteString(buf, "x"); n != 1 || err != nil {
+		t.Errorf("expected 1, nil got %d, %v", n, err)
+	}
+}
+
+func TestDuplexPipe(t *testing.T) {
+	a, b := DuplexPipe()
+
+	// writes don't wait for the peer to read
+	io.WriteString(a, "ping")
+	io.WriteString(b, "pong")
+
+	p := make([]byte, 4)
+	if _, err := io.ReadFull(b, p); err != nil || string(p) != "ping" {
+		t.Errorf("expected ping, nil got %q, %v", p, err)
+	}
+	if _, err := io.ReadFull(a, p); err != nil || string(p) != "pong" {
+		t.Errorf("expected pong, nil got %q, %v", p, err)
+	}
+
+	io.WriteString(a, "bye")
+	a.Close()
+	if _, err := io.WriteString(a, "more"); err != io.ErrClosedPipe {
+		t.Errorf("expected ErrClosedPipe got %v", err)
+	}
+	if data, err := ioutil.ReadAll(b); err != nil || string(data) != "bye" {
+		t.Errorf("expected bye, nil got %q, %v", data, err)
+	}
+
+	// a's read side is still open until b closes
+	io.WriteString(b, "still here")
+	b.Close()
+	if data, err := ioutil.ReadAll(a); err != nil || string(data) != "still here" {
+		t.Errorf("expected still here, nil got %q, %v", data, err)
+	}
+}
+
+func TestReadMessages(t *testing.T) {
+	buf := New()
+	buf.MessageBoundaries()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		io.WriteString(buf, msg)
+	}
+
+	msgs, err := r.ReadMessages(2) // full batch
+	if err != nil || len(msgs) != 2 || string(msgs[0]) != "a" || string(msgs[1]) != "bb" {
+		t.Errorf("expected [a bb], nil got %q, %v", msgs, err)
+	}
+	msgs, err = r.ReadMessages(5) // partial batch, doesn't wait for more
+	if err != nil || len(msgs) != 1 || string(msgs[0]) != "ccc" {
+		t.Errorf("expected [ccc], nil got %q, %v", msgs, err)
+	}
+
+	io.WriteString(buf, "dddd")
+	io.WriteString(buf, "e")
+	buf.Close()
+	msgs, err = r.ReadMessages(5) // closed mid batch
+	if err != io.EOF || len(msgs) != 2 || string(msgs[0]) != "dddd" || string(msgs[1]) != "e" {
+		t.Errorf("expected [dddd e], EOF got %q, %v", msgs, err)
+	}
+	if msgs, err = r.ReadMessages(5); err != io.EOF || len(msgs) != 0 {
+		t.Errorf("expected [], EOF got %q, %v", msgs, err)
+	}
+}
+
+func TestThrottleProducer(t *testing.T) {
+	buf := New()
+	r := buf.NextReader()
+	defer r.Close()
+	buf.ThrottleProducer(1, 4)
+
+	buf.WriteFrom(1, []byte("1111"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf.WriteFrom(1, []byte("11"))
+	}()
+
+	// producer 2 isn't throttled
+	for i := 0; i < 10; i++ {
+		if _, err := buf.WriteFrom(2, []byte("2222")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+		t.Fatal("expected producer 1 to block while the reader lags")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	go io.Copy(ioutil.Discard, r)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected producer 1 to unblock once the reader reads")
+	}
+	buf.Close()
+}
+
+func TestThrottleProducerForReader(t *testing.T) {
+	buf := New()
+	target, other := buf.NextBufferReader(), buf.NextBufferReader()
+	defer other.Close()
+	target.ThrottleProducer(1, 4)
+
+	buf.WriteFrom(1, []byte("1111"))
+	buf.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, err := buf.WriteFrom(1, []byte("11")); n != 0 || err != ErrWriteTimeout {
+		t.Errorf("expected 0, ErrWriteTimeout while the target lags got %d, %v", n, err)
+	}
+
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		io.Copy(ioutil.Discard, target)
+	}()
+	buf.SetWriteDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 10; i++ { // other never reads, but doesn't throttle producer 1
+		if _, err := buf.WriteFrom(1, []byte("1111")); err != nil {
+			t.Fatalf("expected producer 1 not to wait for the other reader got %v", err)
+		}
+	}
+
+	buf.SetWriteDeadline(time.Time{})
+	target.Close() // removes its throttle
+	<-read
+	for i := 0; i < 10; i++ {
+		if _, err := buf.WriteFrom(1, []byte("1111")); err != nil {
+			t.Fatalf("expected producer 1 not to be throttled after the target closed got %v", err)
+		}
+	}
+	buf.Close()
+}
+
+func TestProcess(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, "hello world")
+
+	var seen string
+	n, err := r.Process(8, func(p []byte) (int, error) {
+		seen = string(p)
+		return 5, nil // partial consumption
+	})
+	if n != 5 || err != nil || seen != "hello wo" {
+		t.Errorf("expected 5, nil, hello wo got %d, %v, %q", n, err, seen)
+	}
+
+	errStop := errors.New("stop")
+	n, err = r.Process(100, func(p []byte) (int, error) {
+		seen = string(p)
+		return 1, errStop
+	})
+	if n != 1 || err != errStop || seen != " world" {
+		t.Errorf("expected 1, errStop, \" world\" got %d, %v, %q", n, err, seen)
+	}
+
+	buf.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "world" {
+		t.Errorf("expected world got %q", data)
+	}
+	if n, err := r.Process(1, func(p []byte) (int, error) { return len(p), nil }); n != 0 || err != io.EOF {
+		t.Errorf("expected 0, EOF got %d, %v", n, err)
+	}
+}
+
+func TestPrefault(t *testing.T) {
+	buf := New()
+	buf.Prefault(64)
+	if n, ok := buf.Contiguous(); !ok || n != 64 {
+		t.Errorf("expected 64 contiguous bytes got %d, %v", n, ok)
+	}
+
+	r := buf.NextReader()
+	defer r.Close()
+	io.WriteString(buf, "hello")
+	buf.Prefault(128) // keeps the buffered data
+	buf.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "hello" {
+		t.Errorf("expected hello got %q", data)
+	}
+}
+
+func TestRelativeTell(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello")
+	r, now := buf.NextBufferReader(), buf.NextBufferReaderFromNow()
+	defer r.Close()
+	defer now.Close()
+
+	if rt, nt := r.RelativeTell(), now.RelativeTell(); rt != 0 || nt != 0 {
+		t.Errorf("expected 0, 0 got %d, %d", rt, nt)
+	}
+
+	io.WriteString(buf, " world")
+	io.CopyN(ioutil.Discard, r, 7)
+	io.CopyN(ioutil.Discard, now, 3)
+	if rt, nt := r.RelativeTell(), now.RelativeTell(); rt != 7 || nt != 3 {
+		t.Errorf("expected 7, 3 got %d, %d", rt, nt)
+	}
+
+	r.Discard(4)
+	if rt := r.RelativeTell(); rt != 11 {
+		t.Errorf("expected 11 got %d", rt)
+	}
+}
+
+func TestNextReaderFromNowFull(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 8)), 8)
+	io.WriteString(buf, "12345")
+	buf.Discard(3)
+	io.WriteString(buf, "678901") // exactly full, wrapped around the ring
+
+	r := buf.NextReaderFromNow()
+	defer r.Close()
+	if n, err := buf.Discard(8); n != 8 || err != io.EOF {
+		t.Errorf("expected to discard 8, EOF got %d, %v", n, err)
+	}
+
+	io.WriteString(buf, "xy")
+	buf.Close()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "xy" {
+		t.Errorf("expected xy, nil got %q, %v", data, err)
+	}
+}
+
+func TestNonBlockingReads(t *testing.T) {
+	buf := New()
+	buf.NonBlockingReads()
+	r, rs := buf.NextBufferReader(), buf.NextReaders(1)
+	defer r.Close()
+	defer rs[0].Close()
+
+	p := make([]byte, 5)
+	for _, r := range []*BufferReader{r, rs[0]} {
+		if n, err := r.Read(p); n != 0 || err != nil {
+			t.Errorf("expected 0, nil got %d, %v", n, err)
+		}
+	}
+
+	r.SetBlocking(true)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(buf, "hello")
+	}()
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "hello" {
+		t.Errorf("expected blocking read of hello, nil got %q, %v", p[:n], err)
+	}
+	buf.Close()
+
+	data, err := ioutil.ReadAll(rs[0]) // spins without blocking until the buffer closes
+	if err != nil || string(data) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", data, err)
+	}
+}
+
+func TestExpectReaders(t *testing.T) {
+	buf := New()
+	buf.ExpectReaders(3)
+	io.WriteString(buf, "hello")
+
+	var rs []*BufferReader
+	for i := 0; i < 3; i++ {
+		r := buf.NextBufferReader()
+		defer r.Close()
+		rs = append(rs, r)
+		p := make([]byte, 5)
+		if _, err := io.ReadFull(r, p); err != nil || string(p) != "hello" {
+			t.Errorf("expected reader %d to see hello got %q, %v", i, p, err)
+		}
+		r.SetBlocking(false)
+		r.Read(p) // advances past the read bytes, evicting them unless expected readers are missing
+		r.SetBlocking(true)
+		if i < 2 && buf.Len() != 5 {
+			t.Errorf("expected the opening bytes to be kept for reader %d got len %d", i+1, buf.Len())
+		}
+	}
+
+	io.WriteString(buf, "!")
+	for _, r := range rs {
+		r.Read(make([]byte, 1))
+	}
+	if l := buf.Len(); l != 1 {
+		t.Errorf("expected eviction to resume once all readers joined got len %d", l)
+	}
+}
+
+func TestAlignedEviction(t *testing.T) {
+	buf := New()
+	buf.MessageBoundaries()
+	buf.AlignedEviction()
+	buf.SetMaxLag(6) // advances the reader to arbitrary offsets
+	r := buf.NextReader()
+	defer r.Close()
+
+	io.WriteString(buf, "aaaa")
+	io.WriteString(buf, "bbbb") // reader advanced to 2, inside the first message
+	if l := buf.Len(); l != 8 {
+		t.Errorf("expected 8 retained bytes got %d", l)
+	}
+	io.WriteString(buf, "cccc") // reader advanced to 6, evicts only the first message
+	if l := buf.Len(); l != 8 {
+		t.Errorf("expected 8 retained bytes got %d", l)
+	}
+
+	var out bytes.Buffer
+	buf.DumpTo(&out)
+	if out.String() != "bbbbcccc" {
+		t.Errorf("expected the retained bytes to start on a message boundary got %q", out.String())
+	}
+	p := make([]byte, 6)
+	if n, _ := r.Read(p); string(p[:n]) != "bbcccc" {
+		t.Errorf("expected bbcccc got %q", p[:n])
+	}
+}
+
+func TestOnBeforeDiscard(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 8)), 8)
+	var archived bytes.Buffer
+	buf.OnBeforeDiscard(func(data []byte) { archived.Write(data) })
+	r := buf.NextReader()
+	defer r.Close()
+
+	go func() {
+		for _, s := range []string{"hello ", "world, ", "this wraps ", "the ring"} {
+			io.WriteString(buf, s)
+		}
+		buf.Close()
+	}()
+	data, _ := ioutil.ReadAll(r)
+	buf.Discard(buf.Len())
+
+	if want := "hello world, this wraps the ring"; string(data) != want || archived.String() != want {
+		t.Errorf("expected %q to be read and archived got %q, %q", want, data, archived.String())
+	}
+}
+
+func TestUnreadRune(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 4)), 4)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	go func() {
+		io.WriteString(buf, "ab€d") // € is 3 bytes, wrapping the ring
+		buf.Close()
+	}()
+
+	if c, _ := r.ReadByte(); c != 'a' {
+		t.Errorf("expected a got %q", c)
+	}
+	if err := r.UnreadByte(); err != nil {
+		t.Error(err)
+	}
+	if err := r.UnreadByte(); err != bufio.ErrInvalidUnreadByte {
+		t.Errorf("expected ErrInvalidUnreadByte got %v", err)
+	}
+	if err := r.UnreadRune(); err != bufio.ErrInvalidUnreadRune {
+		t.Errorf("expected ErrInvalidUnreadRune got %v", err)
+	}
+
+	for _, want := range []rune{'a', 'b', '€'} {
+		if c, _, err := r.ReadRune(); c != want || err != nil {
+			t.Errorf("expected %q, nil got %q, %v", want, c, err)
+		}
+	}
+	if err := r.UnreadRune(); err != nil { // the rune spans a fetch and the ring wrap
+		t.Error(err)
+	}
+	if c, size, err := r.ReadRune(); c != '€' || size != 3 || err != nil {
+		t.Errorf("expected €, 3, nil got %q, %d, %v", c, size, err)
+	}
+	r.UnreadByte()
+	if data, _ := ioutil.ReadAll(r); string(data) != "\xacd" {
+		t.Errorf("expected the last byte of € and d got %q", data)
+	}
+}
+
+func TestUnreadByteReadPaths(t *testing.T) {
+	unread := func() *BufferReader {
+		buf := New()
+		buf.MessageBoundaries()
+		r := buf.NextBufferReader()
+		io.WriteString(buf, "hello")
+		buf.Close()
+		r.ReadByte()
+		r.ReadByte()
+		r.UnreadByte()
+		return r
+	}
+	copyAll := func(read func(*BufferReader, *bytes.Buffer)) string {
+		r := unread()
+		defer r.Close()
+		var out bytes.Buffer
+		read(r, &out)
+		return out.String()
+	}
+
+	for name, read := range map[string]func(*BufferReader, *bytes.Buffer){
+		"CopyBufferTo": func(r *BufferReader, out *bytes.Buffer) { r.CopyBufferTo(out, nil) },
+		"WriteTo":      func(r *BufferReader, out *bytes.Buffer) { r.WriteTo(out) },
+		"StreamTo":     func(r *BufferReader, out *bytes.Buffer) { r.StreamTo(out) },
+		"Process": func(r *BufferReader, out *bytes.Buffer) {
+			for {
+				if _, err := r.Process(10, out.Write); err != nil {
+					return
+				}
+			}
+		},
+		"AppendTo": func(r *BufferReader, out *bytes.Buffer) {
+			for {
+				if _, err := r.AppendTo(out, 0); err != nil {
+					return
+				}
+			}
+		},
+		"ReadMessage": func(r *BufferReader, out *bytes.Buffer) {
+			msg, _ := r.ReadMessage()
+			out.Write(msg)
+		},
+		"ReadMessages": func(r *BufferReader, out *bytes.Buffer) {
+			msgs, _ := r.ReadMessages(2)
+			for _, msg := range msgs {
+				out.Write(msg)
+			}
+		},
+		"ReadAtLeastOrAvailable": func(r *BufferReader, out *bytes.Buffer) {
+			p := make([]byte, 10)
+			n, _ := r.ReadAtLeastOrAvailable(p, 1)
+			out.Write(p[:n])
+		},
+	} {
+		if got := copyAll(read); got != "ello" {
+			t.Errorf("%s: expected the unread byte to be read again, got %q", name, got)
+		}
+	}
+
+	r := unread()
+	defer r.Close()
+	if off := r.RelativeTell(); off != 1 {
+		t.Errorf("expected RelativeTell to count the unread byte as unread, got %d", off)
+	}
+}
+
+func TestRecordSizePartialPeek(t *testing.T) {
+	buf := New()
+	buf.RecordSize(4)
+	r := buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, "abcdef")
+
+	p := make([]byte, 8)
+	if n, err := r.Read(p); n != 4 || err != nil {
+		t.Fatalf("expected one record got %d, %v", n, err)
+	}
+	if peeked, err := r.Peek(2); err != nil || string(peeked) != "ef" {
+		t.Errorf("expected the held partial record from Peek got %q, %v", peeked, err)
+	}
+	if d, err := r.Discard(1); d != 1 || err != nil {
+		t.Errorf("expected 1, nil got %d, %v", d, err)
+	}
+	if c, err := r.ReadByte(); c != 'f' || err != nil {
+		t.Errorf("expected f, nil got %q, %v", c, err)
+	}
+}
+
+func TestCompleteWritesOnlyConcurrent(t *testing.T) {
+	buf := NewCapped(4)
+	buf.CompleteWritesOnly()
+	r := buf.NextReader()
+	defer r.Close()
+	io.WriteString(buf, "12") // the writes below block on the cap part way through
+
+	var wg sync.WaitGroup
+	for _, s := range []string{"abcd", "wxyz"} {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			io.WriteString(buf, s)
+		}(s)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, c := range []int{5, 6} { // make room one byte at a time while both writes wait
+		buf.SetCap(c)
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() {
+		wg.Wait()
+		buf.Close()
+	}()
+
+	done := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- string(data)
+	}()
+	select {
+	case out := <-done:
+		if out != "12abcdwxyz" {
+			t.Errorf("expected the writes not to interleave got %q", out)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected both writes to complete")
+	}
+}
+
+func TestReadSpin(t *testing.T) {
+	buf := New()
+	buf.ReadSpin(1000)
+	r := buf.NextReader()
+	defer r.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond) // longer than the spin, so the reader also parks
+		io.WriteString(buf, "hello")
+		buf.Close()
+	}()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", data, err)
+	}
+}
+
+func TestReaderManifest(t *testing.T) {
+	buf := New()
+	buf.NextReader()
+	io.WriteString(buf, "hello")
+	buf.NextReaderFromNow()
+	io.WriteString(buf, "world")
+	buf.NextReaderFromNow()
+
+	cps := buf.ReaderManifest()
+	got := make(map[int64]bool)
+	for _, cp := range cps {
+		got[cp.Offset] = true
+	}
+	if len(cps) != 3 || !got[0] || !got[5] || !got[10] {
+		t.Fatalf("expected checkpoints at 0, 5 and 10 got %v", cps)
+	}
+
+	restored, err := buf.RestoreReaders(append(cps, ReaderCheckpoint{Offset: 100}))
+	if rerr, ok := err.(RestoreError); !ok || len(rerr) != 4 || rerr[3] != ErrOffsetNotRetained || rerr[0] != nil {
+		t.Errorf("expected a RestoreError for the last checkpoint got %v", err)
+	}
+	if restored[3] != nil {
+		t.Error("expected no reader for the unretained checkpoint")
+	}
+	assertNumReaders(6, buf, t)
+
+	io.WriteString(buf, "!")
+	buf.Close()
+	for i, r := range restored[:3] {
+		data, _ := ioutil.ReadAll(r)
+		if want := "helloworld!"[cps[i].Offset:]; string(data) != want {
+			t.Errorf("expected restored reader %d to read %q got %q", i, want, data)
+		}
+	}
+}
+
+func TestReaderManifestMidSnapshot(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	io.WriteString(buf, "helloworld")
+	r.Read(make([]byte, 3)) // the snapshot holds all 10 bytes, 4 of them are read
+	r.ReadByte()
+	r.UnreadByte()
+
+	cps := buf.ReaderManifest()
+	if len(cps) != 1 || cps[0].Offset != 3 {
+		t.Fatalf("expected a checkpoint at 3 got %v", cps)
+	}
+	restored, _ := buf.RestoreReaders(cps)
+	buf.Close()
+	if data, _ := ioutil.ReadAll(restored[0]); string(data) != "loworld" {
+		t.Errorf("expected the restored reader to read %q got %q", "loworld", data)
+	}
+}
+
+func TestReaderManifestRoundTrip(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello")
+	buf.Discard(5) // the snapshot now starts at 5
+
+	a := buf.NextBufferReader() // at 5
+	io.WriteString(buf, "world")
+	b := buf.NextBufferReader() // at 5
+	b.Read(make([]byte, 3))
+	c := buf.NextBufferReaderFromNow() // at 10
+	io.WriteString(buf, "!")
+
+	data, err := buf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cps := buf.ReaderManifest()
+	a.Close()
+	b.Close()
+	c.Close()
+
+	restored := New()
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if s := restored.Stats(); s.BytesWritten != 11 || s.BytesDiscarded != 5 {
+		t.Errorf("expected the restored buffer to hold 5-11 got %+v", s)
+	}
+	rs, err := restored.RestoreReaders(append(cps, ReaderCheckpoint{Offset: 2}))
+	if rerr, ok := err.(RestoreError); !ok || rerr[3] != ErrOffsetNotRetained {
+		t.Errorf("expected ErrOffsetNotRetained for the evicted checkpoint got %v", err)
+	}
+	restored.Close()
+	for i, r := range rs[:3] {
+		out, _ := ioutil.ReadAll(r)
+		if want := "helloworld!"[cps[i].Offset:]; string(out) != want {
+			t.Errorf("expected restored reader %d to read %q got %q", i, want, out)
+		}
+	}
+
+	if err := restored.UnmarshalBinary(data); err != ErrActiveReaders {
+		t.Errorf("expected ErrActiveReaders with open readers got %v", err)
+	}
+	if err := New().UnmarshalBinary(nil); err != ErrMalformedSnapshot {
+		t.Errorf("expected ErrMalformedSnapshot got %v", err)
+	}
+}
+
+func TestReaderManifestConcurrentReads(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, strings.Repeat("x", 100000))
+	buf.Close()
+
+	done := make(chan struct{})
+	go func() { // run with -race to check checkpoints don't read r's state while it reads
+		defer close(done)
+		p := make([]byte, 1)
+		for _, err := r.Read(p); err == nil; _, err = r.Read(p) {
+		}
+	}()
+	last := int64(0)
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		cps := buf.ReaderManifest()
+		if len(cps) != 1 || cps[0].Offset < last || cps[0].Offset > 100000 {
+			t.Fatalf("expected a checkpoint moving forward from %d got %v", last, cps)
+		}
+		last = cps[0].Offset
+	}
+	if cps := buf.ReaderManifest(); cps[0].Offset != 100000 {
+		t.Errorf("expected a checkpoint at 100000 after reading everything got %v", cps)
+	}
+}
+
+func TestNextReaderReplayFrom(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "helloworld")
+	buf.Discard(2) // "lloworld" retained from offset 2
+
+	if r, _, err := buf.NextReaderReplayFrom(100, 0); r != nil || err != ErrOffsetNotRetained {
+		t.Errorf("expected no reader and ErrOffsetNotRetained past the end got %v, %v", r, err)
+	}
+
+	type replay struct {
+		r     *BufferReader
+		start int64
+		err   error
+	}
+	var rs []replay
+	for _, tc := range []struct{ client, margin, start int64 }{
+		{6, 3, 3},  // overlap
+		{6, 0, 6},  // exact resume
+		{4, 10, 2}, // margin clamped to retained data
+		{1, 0, 2},  // evicted
+	} {
+		r, start, err := buf.NextReaderReplayFrom(tc.client, tc.margin)
+		if start != tc.start {
+			t.Errorf("expected replay of %d with margin %d to start at %d got %d", tc.client, tc.margin, tc.start, start)
+		}
+		rs = append(rs, replay{r, start, err})
+	}
+	for i, rp := range rs[:3] {
+		if rp.err != nil {
+			t.Errorf("expected no error for replay %d got %v", i, rp.err)
+		}
+	}
+	if rs[3].err != ErrOffsetNotRetained {
+		t.Errorf("expected ErrOffsetNotRetained for an evicted offset got %v", rs[3].err)
+	}
+
+	buf.Close()
+	for _, rp := range rs {
+		data, _ := ioutil.ReadAll(rp.r)
+		if want := "helloworld"[rp.start:]; string(data) != want {
+			t.Errorf("expected replay from %d to read %q got %q", rp.start, want, data)
+		}
+	}
+}
+
+func TestNextReaderWrites(t *testing.T) {
+	buf := NewCapped(4)
+	w := buf.NextReaderWrites()
+	go func() {
+		io.WriteString(buf, "hello world") // split up by the cap
+		io.WriteString(buf, "!")
+	}()
+	for _, want := range []string{"hello world", "!"} {
+		if p, err := w.NextWrite(); err != nil || string(p) != want {
+			t.Errorf("expected %q, nil got %q, %v", want, p, err)
+		}
+	}
+	w.Close()
+	buf.Discard(buf.Len()) // make room under the cap
+
+	r := buf.NextReaderFromNow()
+	io.WriteString(buf, "ab")
+	buf.mu.Lock()
+	if len(buf.ends) != 0 {
+		t.Errorf("expected no boundaries without write readers got %v", buf.ends)
+	}
+	buf.mu.Unlock()
+	r.Close()
+	buf.Discard(buf.Len()) // make room under the cap
+
+	w = buf.NextReaderWrites()
+	defer w.Close()
+	io.WriteString(buf, "cd")
+	io.WriteString(buf, "ef")
+	buf.Close()
+	for _, want := range []string{"cd", "ef"} {
+		if p, err := w.NextWrite(); err != nil || string(p) != want {
+			t.Errorf("expected %q, nil got %q, %v", want, p, err)
+		}
+	}
+	if p, err := w.NextWrite(); err != io.EOF || len(p) != 0 {
+		t.Errorf("expected EOF got %q, %v", p, err)
+	}
+}
+
+func TestSetReadAhead(t *testing.T) {
+	buf := New()
+	io.WriteString(buf, "hello world, this is a test")
+	r := buf.NextBufferReader()
+	defer r.Close()
+	r.SetReadAhead(4)
+
+	var out bytes.Buffer
+	p := make([]byte, 3)
+	for out.Len() < 27 {
+		buf.mu.Lock()
+		if l := r.data.Len(); l > 4 {
+			t.Fatalf("expected at most 4 bytes read ahead got %d", l)
+		}
+		buf.mu.Unlock()
+		n, _ := r.Read(p)
+		out.Write(p[:n])
+	}
+	if out.String() != "hello world, this is a test" {
+		t.Errorf("expected the whole stream got %q", out.String())
+	}
+}
+
+// gatedWriter blocks writes until gate is closed.
+type gatedWriter struct {
+	gate chan struct{}
+	bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.Buffer.Write(p)
+}
+
+func (w *gatedWriter) ReadFrom(r io.Reader) (int64, error) {
+	<-w.gate
+	return w.Buffer.ReadFrom(r)
+}
+
+func TestAudit(t *testing.T) {
+	buf := New()
+	var log bytes.Buffer
+	stop := buf.Audit(&log, nil)
+	io.WriteString(buf, "hello ")
+	io.WriteString(buf, "world")
+	if err := stop(); err != nil {
+		t.Errorf("expected nil from stop got %v", err)
+	}
+	stop()
+	io.WriteString(buf, "!") // after stop
+	if log.String() != "hello world" {
+		t.Errorf("expected hello world got %q", log.String())
+	}
+
+	slow := &gatedWriter{gate: make(chan struct{})}
+	dropped := 0
+	stop = buf.Audit(slow, func(n int) { dropped += n })
+	for i := 0; i < MaxAuditChunks+10; i++ {
+		io.WriteString(buf, "x")
+	}
+	close(slow.gate)
+	stop()
+	// the auditing goroutine may or may not have taken a chunk before blocking
+	got := slow.String()
+	xs := strings.Count(got, "x")
+	if got != strings.Repeat("x", xs) || xs < MaxAuditChunks {
+		t.Errorf("expected only written bytes in the audit log got %q", got)
+	}
+	if dropped != MaxAuditChunks+10-xs {
+		t.Errorf("expected %d dropped bytes reported got %d", MaxAuditChunks+10-xs, dropped)
+	}
+
+	failing := &fakeFlusher{err: io.ErrShortWrite}
+	stop = buf.Audit(failing, nil)
+	if _, err := io.WriteString(buf, "lost"); err != nil {
+		t.Errorf("expected the audit's error not to fail the write got %v", err)
+	}
+	if err := stop(); err != io.ErrShortWrite {
+		t.Errorf("expected the audit's write error from stop got %v", err)
+	}
+}
+
+func TestAtEOF(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+	if r.AtEOF() {
+		t.Error("expected an open, empty buffer not to be at EOF")
+	}
+
+	io.WriteString(buf, "hello")
+	buf.Close()
+	if r.AtEOF() {
+		t.Error("expected a closed buffer with data not to be at EOF")
+	}
+
+	ioutil.ReadAll(r)
+	if !r.AtEOF() {
+		t.Error("expected a closed, drained buffer to be at EOF")
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("expected 0, EOF got %d, %v", n, err)
+	}
+}
+
+func TestSoftLimit(t *testing.T) {
+	buf := New()
+	buf.SoftLimit(8)
+	r := buf.NextReader()
+	defer r.Close()
+
+	io.WriteString(buf, "hello")
+	io.WriteString(buf, " world") // starts under the limit, so it's written whole
+	if l := buf.Len(); l != 11 {
+		t.Errorf("expected 11 bytes got %d", l)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.WriteString(buf, "!")
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the write to block at the soft limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p := make([]byte, 11)
+	io.ReadFull(r, p)
+	go r.Read(p[:1]) // advances the reader, freeing space
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the write to resume after the reader advanced")
+	}
+}
+
+func TestReadWithCancel(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+	p := make([]byte, 5)
+	if n, err := r.ReadWithCancel(p, cancel); n != 0 || err != ErrReadCanceled {
+		t.Errorf("expected 0, ErrReadCanceled got %d, %v", n, err)
+	}
+	if n, err := r.ReadWithCancel(p, cancel); n != 0 || err != ErrReadCanceled {
+		t.Errorf("expected an already canceled read to fail got %d, %v", n, err)
+	}
+
+	io.WriteString(buf, "hello")
+	if n, err := r.ReadWithCancel(p, make(chan struct{})); err != nil || string(p[:n]) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", p[:n], err)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	buf := New()
+	r, other := buf.NextBufferReader(), buf.NextBufferReader()
+	defer r.Close()
+	defer other.Close()
+
+	read := make(chan string)
+	go func() {
+		p := make([]byte, 5)
+		n, _ := other.ReadContext(context.Background(), p)
+		read <- string(p[:n])
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	p := make([]byte, 5)
+	if n, err := r.ReadContext(ctx, p); n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("expected 0, context.DeadlineExceeded got %d, %v", n, err)
+	}
+
+	select {
+	case s := <-read:
+		t.Fatalf("expected the other reader to keep waiting got %q", s)
+	case <-time.After(10 * time.Millisecond):
+	}
+	io.WriteString(buf, "hello")
+	if s := <-read; s != "hello" {
+		t.Errorf("expected the other reader to read hello got %q", s)
+	}
+	if n, err := r.ReadContext(context.Background(), p); err != nil || string(p[:n]) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", p[:n], err)
+	}
+}
+
+func TestDefaultReadTimeout(t *testing.T) {
+	buf := New()
+	buf.DefaultReadTimeout(10 * time.Millisecond)
+	r := buf.NextReader()
+	defer r.Close()
+
+	p := make([]byte, 5)
+	if n, err := r.Read(p); n != 0 || err != ErrReadTimeout || !os.IsTimeout(err) {
+		t.Errorf("expected 0, ErrReadTimeout got %d, %v", n, err)
+	}
+	io.WriteString(buf, "hello")
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", p[:n], err)
+	}
+
+	o := buf.NextBufferReaderFromNow()
+	defer o.Close()
+	o.SetReadTimeout(0)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		io.WriteString(buf, "world")
+	}()
+	if n, err := o.Read(p); err != nil || string(p[:n]) != "world" {
+		t.Errorf("expected the overridden reader to wait for world got %q, %v", p[:n], err)
+	}
+}
+
+func TestReadWithCancelAndTimeout(t *testing.T) {
+	buf := New()
+	buf.DefaultReadTimeout(time.Hour)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	cancel := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(cancel) })
+	p := make([]byte, 5)
+	if n, err := r.ReadWithCancel(p, cancel); n != 0 || err != ErrReadCanceled {
+		t.Errorf("expected 0, ErrReadCanceled got %d, %v", n, err)
+	}
+
+	r.SetReadTimeout(10 * time.Millisecond)
+	ctx, stop := context.WithTimeout(context.Background(), time.Hour)
+	defer stop()
+	if n, err := r.ReadContext(ctx, p); n != 0 || err != ErrReadTimeout {
+		t.Errorf("expected 0, ErrReadTimeout got %d, %v", n, err)
+	}
+
+	io.WriteString(buf, "hello")
+	if n, err := r.ReadWithCancel(p, make(chan struct{})); err != nil || string(p[:n]) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", p[:n], err)
+	}
+}
+
+type fakeFlusher struct {
+	bytes.Buffer
+	chunks  []string
+	flushed int
+	err     error
+}
+
+func (f *fakeFlusher) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.chunks = append(f.chunks, string(p))
+	return f.Buffer.Write(p)
+}
+
+func (f *fakeFlusher) Flush() { f.flushed++ }
+
+func TestStreamTo(t *testing.T) {
+	buf := New()
+	r := buf.NextBufferReader()
+	w := &fakeFlusher{}
+	done := make(chan error)
+	go func() {
+		_, err := r.StreamTo(w)
+		done <- err
+	}()
+	for _, s := range []string{"data: 1\n\n", "data: 2\n\n"} {
+		io.WriteString(buf, s)
+		time.Sleep(10 * time.Millisecond) // let each write be streamed on its own
+	}
+	buf.Close()
+	if err := <-done; err != nil {
+		t.Errorf("expected nil at the end of the buffer got %v", err)
+	}
+	if w.String() != "data: 1\n\ndata: 2\n\n" || w.flushed != len(w.chunks) || w.flushed < 2 {
+		t.Errorf("expected a flush after each chunk got %q in %d chunks with %d flushes", w.String(), len(w.chunks), w.flushed)
+	}
+
+	buf = New()
+	r = buf.NextBufferReader()
+	io.WriteString(buf, "gone")
+	w = &fakeFlusher{err: io.ErrClosedPipe} // client disconnected
+	if _, err := r.StreamTo(w); err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe got %v", err)
+	}
+	if !r.Closed() || w.flushed != 0 {
+		t.Errorf("expected the reader to be closed without flushing got closed %v, %d flushes", r.Closed(), w.flushed)
+	}
+}
+
+func TestDrainOnCloseTo(t *testing.T) {
+	var sink bytes.Buffer
+	buf := New()
+	buf.DrainOnCloseTo(&sink)
+	r := buf.NextReader()
+	io.WriteString(buf, "hello ")
+	p := make([]byte, 6)
+	io.ReadFull(r, p)
+	io.WriteString(buf, "world")
+	io.ReadFull(r, p[:3]) // moves r past hello, but world isn't fully read
+	if err := buf.Close(); err != nil {
+		t.Errorf("expected nil close error got %v", err)
+	}
+	r.Close() // abandons the rest
+	if sink.String() != "world" {
+		t.Errorf("expected the sink to get the undelivered world got %q", sink.String())
+	}
+
+	sink.Reset()
+	buf = New()
+	buf.DrainOnCloseTo(&sink)
+	io.WriteString(buf, "nobody read this")
+	buf.Close()
+	buf.Close() // only drains once
+	if sink.String() != "nobody read this" {
+		t.Errorf("expected the sink to get everything without readers got %q", sink.String())
+	}
+
+	slow := &gatedWriter{gate: make(chan struct{})}
+	buf = New()
+	buf.DrainOnCloseTo(slow)
+	io.WriteString(buf, "slow")
+	done, closed := buf.done, make(chan error)
+	go func() { closed <- buf.Close() }()
+	<-done
+	buf.Len() // not blocked by the sink
+	close(slow.gate)
+	if err := <-closed; err != nil || slow.String() != "slow" {
+		t.Errorf("expected the slow sink to get slow, nil got %q, %v", slow.String(), err)
+	}
+
+	w, err := NewTempFileWriter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	slow = &gatedWriter{gate: make(chan struct{})}
+	buf = NewBuffer(w)
+	buf.DrainOnCloseTo(slow)
+	r = buf.NextReader()
+	io.WriteString(buf, "from the file")
+	done = buf.done
+	go func() { closed <- buf.Close() }()
+	<-done
+	r.Close() // would drain the file if the sink's data wasn't kept
+	buf.Discard(buf.Len())
+	if err := buf.Reset(); err != ErrActiveReaders {
+		t.Errorf("expected Reset to wait for the sink got %v", err)
+	}
+	close(slow.gate)
+	if err := <-closed; err != nil || slow.String() != "from the file" {
+		t.Errorf("expected the sink to get from the file, nil got %q, %v", slow.String(), err)
+	}
+
+	buf = New()
+	buf.DrainOnCloseTo(&fakeFlusher{err: io.ErrShortWrite})
+	io.WriteString(buf, "lost")
+	if err := buf.Close(); err != io.ErrShortWrite {
+		t.Errorf("expected the sink's error from Close got %v", err)
+	}
+}
+
+func TestPostCloseRetention(t *testing.T) {
+	buf := New()
+	buf.PostCloseRetention(50 * time.Millisecond)
+	r := buf.NextReader()
+	io.WriteString(buf, "result")
+	buf.Close()
+	ioutil.ReadAll(r)
+	r.Close()
+
+	late := buf.NextReader()
+	if data, err := ioutil.ReadAll(late); err != nil || string(data) != "result" {
+		t.Errorf("expected a late reader to read result got %q, %v", data, err)
+	}
+	late.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if l := buf.Len(); l != 0 {
+		t.Errorf("expected the data to be evicted after the retention got len %d", l)
+	}
+}
+
+func TestGrowCount(t *testing.T) {
+	buf := NewBuffer(NewMemoryWriter(make([]byte, 0, 1)))
+	for i := 0; i < 16; i++ { // grows to 3, 7, 15 and 31 bytes
+		buf.Write([]byte{byte(i)})
+	}
+	if n := buf.GrowCount(); n != 4 {
+		t.Errorf("expected 4 grows got %d", n)
+	}
+	buf.Prefault(64) // not a grow
+	buf.Write(make([]byte, 40))
+	if n := buf.GrowCount(); n != 4 {
+		t.Errorf("expected 4 grows got %d", n)
+	}
+}
+
+func TestPeakReaders(t *testing.T) {
+	buf := New()
+	var rs []io.ReadCloser
+	for i := 0; i < 5; i++ {
+		rs = append(rs, buf.NextReader())
+	}
+	rs[0].Close()
+	rs[1].Close()
+	rs = rs[2:]
+	for _, r := range buf.NextReaders(3) {
+		rs = append(rs, r)
+	}
+	assertNumReaders(6, buf, t)
+	for _, r := range rs {
+		r.Close()
+	}
+	assertNumReaders(0, buf, t)
+
+	if n := buf.PeakReaders(); n != 6 {
+		t.Errorf("expected peak of 6 readers got %d", n)
+	}
+	if n := buf.ReadersOpened(); n != 8 {
+		t.Errorf("expected 8 readers opened got %d", n)
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	var mu sync.Mutex
+	pressure := true
+	setPressure := func(p bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		pressure = p
+	}
+	allocated := func(buf *Buffer) int {
+		buf.mu.Lock()
+		defer buf.mu.Unlock()
+		return buf.buf.(*writer).Cap()
+	}
+
+	buf := NewBuffer(NewMemoryWriter(make([]byte, 0, 8)))
+	buf.SetMemoryPressureFunc(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pressure
+	})
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	io.WriteString(buf, "abcd") // fits in the allocated memory
+	wrote := make(chan bool)
+	big := bytes.Repeat([]byte("x"), 2*minShrink) // large enough to be shrunk again
+	go func() {
+		_, blocked, _ := buf.WriteReport(big)
+		wrote <- blocked
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("expected the write to block instead of growing under pressure")
+	case <-time.After(30 * time.Millisecond):
+	}
+	setPressure(false)
+	if !<-wrote {
+		t.Error("expected the write to report it blocked")
+	}
+	if n := buf.GrowCount(); n != 1 {
+		t.Errorf("expected the buffer to grow once the pressure cleared got %d grows", n)
+	}
+
+	setPressure(true)
+	p := make([]byte, 4+len(big))
+	if _, err := io.ReadFull(r, p); err != nil || string(p) != "abcd"+string(big) {
+		t.Errorf("expected abcd and %d bytes, nil got %d bytes, %v", len(big), len(p), err)
+	}
+	grown := allocated(buf)
+	r.SetBlocking(false)
+	r.Read(p) // evicts what was read
+	if c := allocated(buf); c >= grown {
+		t.Errorf("expected the buffer to shrink from %d under pressure got %d", grown, c)
+	}
+
+	setPressure(false)
+	if n, err := buf.Write(make([]byte, 100)); n != 100 || err != nil {
+		t.Errorf("expected 100, nil got %d, %v", n, err)
+	}
+
+	setPressure(true)
+	alone := NewBuffer(NewMemoryWriter(make([]byte, 0, 8)))
+	alone.SetMemoryPressureFunc(func() bool { return true })
+	if n, err := alone.WriteDeadline(make([]byte, 100), time.Now().Add(time.Second)); n != 100 || err != nil {
+		t.Errorf("expected a write without readers not to wait for memory got %d, %v", n, err)
+	}
+}
+
+func TestMemoryPressurePanic(t *testing.T) {
+	buf := NewBuffer(NewMemoryWriter(make([]byte, 0, 8)))
+	var recovered []interface{}
+	buf.SetPanicHandler(func(rec interface{}) { recovered = append(recovered, rec) })
+	buf.SetMemoryPressureFunc(func() bool { panic("pressure") })
+	r := buf.NextReader()
+	defer r.Close()
+
+	if n, err := buf.WriteDeadline(make([]byte, 100), time.Now().Add(time.Second)); n != 100 || err != nil {
+		t.Errorf("expected a panic to count as no pressure got %d, %v", n, err)
+	}
+	if len(recovered) != 1 || recovered[0] != "pressure" {
+		t.Errorf("expected the panic to reach the handler got %v", recovered)
+	}
+}
+
+func TestNextChannelReader(t *testing.T) {
+	buf := New()
+	ch, stop := buf.NextChannelReader(4)
+	defer stop()
+	io.WriteString(buf, "hello world")
+	buf.Close()
+
+	var got []byte
+	for p := range ch { // closed at EOF
+		if len(p) > 4 {
+			t.Errorf("expected chunks of at most 4 bytes got %q", p)
+		}
+		got = append(got, p...)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("expected hello world got %q", got)
+	}
+
+	buf = New()
+	ch, stop = buf.NextChannelReader(0)
+	io.WriteString(buf, "hello")
+	p := <-ch
+	p[0] = 'j' // chunks are copies
+	if string(p) != "jello" {
+		t.Errorf("expected jello got %q", p)
+	}
+	io.WriteString(buf, "world") // never received
+	stop()
+	stop()
+	for range ch {
+	}
+	assertNumReaders(0, buf, t)
+}
+
+func TestReset(t *testing.T) {
+	buf := New()
+	r := buf.NextReader()
+	io.WriteString(buf, "hello world")
+	buf.Close()
+	if err := buf.Reset(); err != ErrActiveReaders {
+		t.Errorf("expected ErrActiveReaders got %v", err)
+	}
+	if data, _ := ioutil.ReadAll(r); string(data) != "hello world" {
+		t.Errorf("unexpected data %q", data)
+	}
+	r.Close()
+	_, _, cap, _, _ := buf.debugRing()
+
+	if err := buf.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected empty buffer got %d", buf.Len())
+	}
+	if _, _, c, empty, _ := buf.debugRing(); c != cap || !empty {
+		t.Errorf("expected empty ring with cap %d got %d %v", cap, c, empty)
+	}
+
+	r = buf.NextReader()
+	defer r.Close()
+	if _, err := io.WriteString(buf, "again"); err != nil {
+		t.Fatal(err)
+	}
+	buf.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "again" {
+		t.Errorf("unexpected data %q", data)
+	}
+}
+
+func TestResetStaleState(t *testing.T) {
+	buf := New()
+	buf.PostCloseRetention(20 * time.Millisecond)
+	buf.ExpectReaders(2)
+	buf.SetMaxReaderAge(time.Hour)
+	io.WriteString(buf, "old data")
+	buf.Close()
+	if err := buf.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(buf, "x")
+	buf.Discard(1) // no readers are expected after Reset
+	if buf.Len() != 0 {
+		t.Errorf("expected Discard to drop everything got len %d", buf.Len())
+	}
+
+	io.WriteString(buf, "new data")
+	time.Sleep(40 * time.Millisecond) // the retention armed by Close must not evict the new data
+	r := buf.NextReader()
+	defer r.Close()
+	buf.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "new data" {
+		t.Errorf("expected new data got %q", data)
+	}
+}
+
+func TestNextTeeReader(t *testing.T) {
+	buf := New()
+	var tee bytes.Buffer
+	r := buf.NextTeeReader(&tee)
+	defer r.Close()
+	io.WriteString(buf, "hello world")
+	buf.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "hello world" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if tee.String() != "hello world" {
+		t.Errorf("unexpected tee %q", tee.String())
+	}
+	assertNumReaders(1, buf, t)
+
+	buf = New()
+	fail := errors.New("tee failed")
+	r = buf.NextTeeReader(&fakeFlusher{err: fail})
+	io.WriteString(buf, "hello")
+	if n, err := r.Read(make([]byte, 5)); n != 5 || err != fail {
+		t.Errorf("expected 5, %v got %d, %v", fail, n, err)
+	}
+	r.Close()
+	assertNumReaders(0, buf, t)
+}
+
+func TestSetReadDeadline(t *testing.T) {
+	buf := New()
+	defer buf.Close()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	r.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	if n, err := r.Read(make([]byte, 5)); n != 0 || !os.IsTimeout(err) {
+		t.Errorf("expected timeout got %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("read returned after %v, before the deadline", elapsed)
+	}
+	if _, err := r.Read(make([]byte, 5)); err != ErrReadTimeout {
+		t.Errorf("expected ErrReadTimeout after the deadline got %v", err)
+	}
+
+	r.SetReadDeadline(time.Time{})
+	io.WriteString(buf, "hello")
+	p := make([]byte, 5)
+	if n, err := r.Read(p); n != 5 || err != nil || string(p) != "hello" {
+		t.Errorf("unexpected read %d, %v, %q", n, err, p)
+	}
+}
+
+func TestSetReadDeadlineWhileBlocked(t *testing.T) {
+	buf := New()
+	defer buf.Close()
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 5))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let Read block
+	r.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	select {
+	case err := <-done:
+		if err != ErrReadTimeout {
+			t.Errorf("expected ErrReadTimeout got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the blocked Read to return once the deadline passed")
+	}
+
+	r.SetReadDeadline(time.Now().Add(time.Hour))
+	io.WriteString(buf, "hello")
+	if n, err := r.Read(make([]byte, 5)); n != 5 || err != nil {
+		t.Errorf("expected 5, nil after a new deadline got %d, %v", n, err)
+	}
+}
+func TestSetWriteDeadline(t *testing.T) {
+	buf := NewCapped(4)
+	r := buf.NextReader()
+	defer r.Close()
+
+	buf.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := buf.Write([]byte("hello world"))
+	if n != 4 || !os.IsTimeout(err) {
+		t.Errorf("expected 4 and a timeout got %d, %v", n, err)
+	}
+	if err == io.ErrClosedPipe {
+		t.Errorf("expected the timeout to differ from io.ErrClosedPipe")
+	}
+
+	buf.SetWriteDeadline(time.Time{})
+	buf.Close()
+	if _, err := buf.Write([]byte("o")); os.IsTimeout(err) {
+		t.Errorf("expected writing to a closed buffer not to be a timeout got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	buf := New()
+	slow, fast := buf.NextReader(), buf.NextReader()
+	defer slow.Close()
+	defer fast.Close()
+
+	io.WriteString(buf, "hello")
+	io.ReadFull(fast, make([]byte, 5))
+	io.ReadFull(slow, make([]byte, 2))
+	io.WriteString(buf, "world")
+	io.ReadFull(fast, make([]byte, 5)) // moves fast past hello, slow still holds it
+
+	s := buf.Stats()
+	if s.BytesWritten != 10 || s.BytesDiscarded != 0 || s.SlowestOffset != 0 {
+		t.Errorf("expected 10 written, 0 discarded, slowest at 0 got %+v", s)
+	}
+	sort.Slice(s.BytesRead, func(i, j int) bool { return s.BytesRead[i] < s.BytesRead[j] })
+	if len(s.BytesRead) != 2 || s.BytesRead[0] != 2 || s.BytesRead[1] != 10 {
+		t.Errorf("expected readers to have read 2 and 10 bytes got %v", s.BytesRead)
+	}
+	if s.ReadersOpened != 2 || s.PeakReaders != 2 {
+		t.Errorf("expected 2 readers opened and peak got %d and %d", s.ReadersOpened, s.PeakReaders)
+	}
+	if s.GrowCount != buf.GrowCount() || s.GrowCount == 0 {
+		t.Errorf("expected GrowCount %d got %d", buf.GrowCount(), s.GrowCount)
+	}
+
+	io.ReadFull(slow, make([]byte, 4)) // moves slow past hello
+	if s := buf.Stats(); s.BytesDiscarded != 5 || s.SlowestOffset != 5 {
+		t.Errorf("expected 5 discarded, slowest at 5 got %+v", s)
+	}
+}
+
+func TestMaxLagOfSlowestReader(t *testing.T) {
+	buf := New()
+	defer buf.Close()
+	if lag := buf.MaxLag(); lag != 0 {
+		t.Errorf("expected no lag without readers got %d", lag)
+	}
+
+	slow := buf.NextReader()
+	defer slow.Close()
+	io.WriteString(buf, "hello")
+	fast := buf.NextReaderFromNow()
+	defer fast.Close()
+	io.WriteString(buf, "world")
+	if lag := buf.MaxLag(); lag != 10 {
+		t.Errorf("expected lag 10 got %d", lag)
+	}
+
+	slow.Close()
+	if lag := buf.MaxLag(); lag != 5 {
+		t.Errorf("expected lag 5 after closing the slowest reader got %d", lag)
+	}
+}
+
+func TestDropSlowestReader(t *testing.T) {
+	buf := NewCapped(4)
+	buf.SetFullBehavior(DropSlowestReader)
+	defer buf.Close()
+	slow := buf.NextBufferReader()
+	defer slow.Close()
+
+	io.WriteString(buf, "hell")
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(buf, "o w")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the write not to block")
+	}
+
+	p := make([]byte, 4)
+	if n, err := slow.Read(p); n != 0 || err != ErrDropped {
+		t.Errorf("expected 0, ErrDropped got %d, %v", n, err)
+	}
+	if d := slow.Dropped(); d != 3 {
+		t.Errorf("expected 3 dropped bytes got %d", d)
+	}
+	if n, err := slow.Read(p); err != nil || string(p[:n]) != "lo w" {
+		t.Errorf("expected lo w, nil got %q, %v", p[:n], err)
+	}
+}
+
+func TestDropSlowestReaderWriteTo(t *testing.T) {
+	buf := NewCapped(4)
+	buf.SetFullBehavior(DropSlowestReader)
+	slow := buf.NextBufferReader()
+	defer slow.Close()
+
+	io.WriteString(buf, "abcd")
+	io.WriteString(buf, "efghij")
+	buf.Close()
+
+	var out bytes.Buffer
+	if n, err := slow.WriteTo(&out); n != 0 || err != ErrDropped {
+		t.Errorf("expected 0, ErrDropped got %d, %v", n, err)
+	}
+	if d := slow.Dropped(); d != 6 {
+		t.Errorf("expected 6 dropped bytes got %d", d)
+	}
+	if n, err := slow.WriteTo(&out); err != nil || out.String() != "ghij" {
+		t.Errorf("expected ghij, nil after the gap was reported got %q (%d), %v", out.String(), n, err)
+	}
+}
+
+func TestCloseSlowestReader(t *testing.T) {
+	buf := NewCapped(4)
+	buf.SetFullBehavior(CloseSlowestReader)
+	defer buf.Close()
+	slow := buf.NextBufferReader()
+	defer slow.Close()
+	io.WriteString(buf, "hell")
+	fast := buf.NextBufferReaderFromNow()
+	defer fast.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(buf, "o")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the write not to block")
+	}
+
+	if !slow.Closed() {
+		t.Errorf("expected the slowest reader to be closed")
+	}
+	if _, err := slow.Read(make([]byte, 4)); err != ErrSlowReader {
+		t.Errorf("expected ErrSlowReader got %v", err)
+	}
+	var out bytes.Buffer
+	if n, err := slow.WriteTo(&out); n != 0 || err != ErrSlowReader {
+		t.Errorf("expected 0, ErrSlowReader from WriteTo got %d, %v", n, err)
+	}
+	if _, err := slow.Discard(1); err != ErrSlowReader {
+		t.Errorf("expected ErrSlowReader from Discard got %v", err)
+	}
+	if _, err := slow.ReadByte(); err != ErrSlowReader {
+		t.Errorf("expected ErrSlowReader from ReadByte got %v", err)
+	}
+	assertNumReaders(1, buf, t)
+	p := make([]byte, 4)
+	if n, err := fast.Read(p); err != nil || string(p[:n]) != "o" {
+		t.Errorf("expected o, nil got %q, %v", p[:n], err)
+	}
+
+	io.WriteString(buf, "wor")
+	go io.WriteString(buf, "ld") // the last reader blocks the write
+	time.Sleep(20 * time.Millisecond)
+	if fast.Closed() {
+		t.Errorf("expected the last reader to stay open")
+	}
+}
+
+func TestByteReaderWriter(t *testing.T) {
+	buf := NewCapped(2)
+	var w io.ByteWriter = buf
+	var r io.ByteReader = buf.NextBufferReader()
+
+	go func() {
+		for _, c := range []byte("hello") {
+			w.WriteByte(c)
+		}
+		buf.Close()
+	}()
+
+	var got []byte
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+	}
+	if string(got) != "hello" {
+		t.Errorf("expected hello got %q", got)
+	}
+	if err := buf.WriteByte('!'); err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe got %v", err)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	buf := New()
+	defer buf.Close()
+	r := buf.NextBufferReader()
+	defer r.Close()
+	io.WriteString(buf, "header:body")
+
+	p := make([]byte, 7)
+	io.ReadFull(r, p)
+	if off, err := r.Seek(0, io.SeekStart); off != 0 || err != nil {
+		t.Errorf("expected 0, nil got %d, %v", off, err)
+	}
+	if _, err := io.ReadFull(r, p); err != nil || string(p) != "header:" {
+		t.Errorf("expected header: again got %q, %v", p, err)
+	}
+	if off, err := r.Seek(-1, io.SeekCurrent); off != 6 || err != nil {
+		t.Errorf("expected 6, nil got %d, %v", off, err)
+	}
+
+	if off, err := r.Seek(-2, io.SeekEnd); off != 9 || err != nil {
+		t.Errorf("expected 9, nil got %d, %v", off, err)
+	}
+	if n, _ := r.Read(p); string(p[:n]) != "dy" {
+		t.Errorf("expected dy got %q", p[:n])
+	}
+	if _, err := r.Seek(1, io.SeekEnd); err != ErrSeekRange {
+		t.Errorf("expected ErrSeekRange past the end got %v", err)
+	}
+	if _, err := r.Seek(-4, io.SeekCurrent); err != ErrSeekRange {
+		t.Errorf("expected ErrSeekRange for data evicted after seeking forward got %v", err)
+	}
+}
+
+func TestVarintFrame(t *testing.T) {
+	buf := NewCappedBuffer(NewMemoryWriter(make([]byte, 0, 8)), 8)
+	r := buf.NextBufferReader()
+	defer r.Close()
+
+	frames := [][]byte{{}, []byte("hello"), bytes.Repeat([]byte("x"), 300)} // 300 has a 2 byte varint
+	go func() {
+		for _, p := range frames {
+			buf.WriteVarintFrame(p) // split across fetches and the ring wrap by the small cap
+		}
+		buf.Write([]byte{0x80}) // truncated prefix
+		buf.Close()
+	}()
+
+	for _, want := range frames {
+		if p, err := r.ReadVarintFrame(); err != nil || !bytes.Equal(p, want) {
+			t.Errorf("expected %d bytes, nil got %d, %v", len(want), len(p), err)
+		}
+	}
+	if _, err := r.ReadVarintFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected ErrUnexpectedEOF got %v", err)
+	}
+	if _, err := r.ReadVarintFrame(); err != io.EOF {
+		t.Errorf("expected EOF got %v", err)
+	}
+
+	buf = New()
+	r = buf.NextBufferReader()
+	defer r.Close()
+	buf.Write([]byte{0x85, 0x80, 0x00}) // a non-minimal encoding of 5
+	io.WriteString(buf, "hello")
+	if p, err := r.ReadVarintFrame(); err != nil || string(p) != "hello" {
+		t.Errorf("expected hello, nil got %q, %v", p, err)
+	}
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff, 0x7f})
+	if _, err := r.ReadVarintFrame(); err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge got %v", err)
+	}
+	buf.Write(bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64))
+	if _, err := r.ReadVarintFrame(); err != ErrMalformedVarint {
+		t.Errorf("expected ErrMalformedVarint got %v", err)
+	}
+
+	buf = New()
+	r = buf.NextBufferReader()
+	defer r.Close()
+	r.SetMaxVarintFrame(4)
+	buf.WriteVarintFrame([]byte("hello"))
+	if _, err := r.ReadVarintFrame(); err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge got %v", err)
+	}
+	if p, _ := r.Peek(5); string(p) != "hello" {
+		t.Errorf("expected the frame's data to be left unread got %q", p)
+	}
+}
@@ -0,0 +1,44 @@
+package bufit
+
+import "sync"
+
+// NextChannelReader returns a channel which receives the buffer's data in chunks of up to chunkSize bytes,
+// starting at the same position NextReader would, and is closed at EOF. Each chunk is a new slice which is
+// safe to retain. The reader doesn't read ahead of the channel's receiver, so it holds back eviction like any
+// other reader until the chunks are received. The returned func stops the reader and closes the channel,
+// it's safe to call more than once. A chunkSize <= 0 reads 32KB chunks.
+func (b *Buffer) NextChannelReader(chunkSize int) (<-chan []byte, func()) {
+	if chunkSize <= 0 {
+		chunkSize = 32 * 1024
+	}
+	r := b.NextBufferReader()
+	ch := make(chan []byte)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			r.Close()
+		})
+	}
+
+	go func() {
+		defer close(ch)
+		defer r.Close()
+		for {
+			p := make([]byte, chunkSize)
+			n, err := r.Read(p)
+			if n > 0 {
+				select {
+				case ch <- p[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch, stop
+}
@@ -0,0 +1,137 @@
+package bufit
+
+import "io"
+
+// EventKind identifies which lifecycle transition an Event describes.
+type EventKind int
+
+const (
+	// ReaderJoined is emitted when NextReader or NextReaderFromNow returns a new reader.
+	ReaderJoined EventKind = iota
+
+	// ReaderLeft is emitted when a reader is closed.
+	ReaderLeft
+
+	// BufferClosed is emitted when the Buffer is closed.
+	BufferClosed
+
+	// Evicted is emitted when bytes read by all readers are dropped from the buffer.
+	Evicted
+
+	// WriteBlocked is emitted when a Write blocks because the buffer is at its cap.
+	WriteBlocked
+
+	// WriteUnblocked is emitted when a blocked Write resumes.
+	WriteUnblocked
+
+	// WriteFailed is emitted when a Write returns an error.
+	WriteFailed
+
+	// ReaderLagged is emitted when a reader is advanced because it fell too far behind.
+	ReaderLagged
+
+	// ReaderExpired is emitted when a reader is advanced because it didn't read for too long.
+	ReaderExpired
+)
+
+// Event describes a lifecycle transition of a Buffer.
+type Event struct {
+	Kind EventKind
+
+	// Readers is the # of open readers at the time of the event.
+	Readers int
+
+	// N is the # of bytes evicted for Evicted events, or dropped for ReaderLagged and ReaderExpired events.
+	N int
+
+	// Err is the error returned by Write for WriteFailed events.
+	Err error
+}
+
+// SetEventHook registers hook to be called with every lifecycle Event of this Buffer, a nil hook
+// disables events. Events are queued while the Buffer is locked and hook is called after the method
+// which caused them has released its locks, so hook may call any Buffer or reader method.
+// Hook may be called concurrently from multiple goroutines (e.g. a Read and a Write), events
+// are delivered in order per call but not across concurrent calls. Hook should not block for long
+// since it delays the return of the method which triggered it. Events which occur while no hook is
+// registered are not delivered.
+func (b *Buffer) SetEventHook(hook func(ev Event)) {
+	b.hook.Store(hook)
+}
+
+// emit queues ev for delivery by flush.
+func (b *Buffer) emit(ev Event) {
+	if hook, _ := b.hook.Load().(func(Event)); hook == nil {
+		return
+	}
+	b.evmu.Lock()
+	defer b.evmu.Unlock()
+	b.events = append(b.events, ev)
+}
+
+// OnBeforeDiscard registers hook to be called with a copy of the bytes evicted from the buffer, in the
+// order they were evicted, so they can be archived. A nil hook disables it. Copying every evicted byte
+// is costly, so only register it when the content is needed (the Evicted event only reports counts).
+// Like SetEventHook the hook is called after the Buffer's locks are released, and calls are never
+// concurrent: if the hook is already running, bytes evicted meanwhile (even by the hook itself) are
+// delivered by that call once it returns. This method is safe to call concurrently with all other methods.
+func (b *Buffer) OnBeforeDiscard(hook func(data []byte)) {
+	b.discardHook.Store(hook)
+}
+
+// beforeDiscard queues a copy of the next n bytes of the buffer for the discard hook, b.mu must be held.
+func (b *Buffer) beforeDiscard(n int) {
+	if hook, _ := b.discardHook.Load().(func([]byte)); hook == nil || n <= 0 {
+		return
+	}
+	data := make([]byte, n)
+	n, _ = io.ReadFull(b.buf.NextReader(), data)
+	b.evmu.Lock()
+	defer b.evmu.Unlock()
+	b.discarded = append(b.discarded, data[:n])
+}
+
+// flushDiscards delivers queued evicted bytes to the discard hook, unless another call already is.
+func (b *Buffer) flushDiscards() {
+	hook, _ := b.discardHook.Load().(func([]byte))
+	b.evmu.Lock()
+	if hook == nil || b.delivering {
+		b.evmu.Unlock()
+		return
+	}
+	b.delivering = true
+	finished := false
+	defer func() {
+		if !finished { // the hook panicked
+			b.evmu.Lock()
+			b.delivering = false
+			b.evmu.Unlock()
+		}
+	}()
+	for len(b.discarded) > 0 {
+		data := b.discarded[0]
+		b.discarded = b.discarded[1:]
+		b.evmu.Unlock()
+		b.call(func() { hook(data) })
+		b.evmu.Lock()
+	}
+	b.delivering, finished = false, true
+	b.evmu.Unlock()
+}
+
+// flush delivers queued events to the hooks, it must be called without holding b.mu.
+func (b *Buffer) flush() {
+	b.flushDiscards()
+	hook, _ := b.hook.Load().(func(Event))
+	if hook == nil {
+		return
+	}
+	b.evmu.Lock()
+	events := b.events
+	b.events = nil
+	b.evmu.Unlock()
+	for _, ev := range events {
+		ev := ev
+		b.call(func() { hook(ev) })
+	}
+}
@@ -0,0 +1,160 @@
+package bufit
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FileWriter is a Writer for use with NewBuffer which stores bytes in a file rather than memory, for buffers
+// too large to hold in RAM. Its Readers read the file with ReadAt, so any number of them can read concurrently
+// with writes. Once the buffer is fully drained the file is truncated and reused from the start. Until then,
+// on Linux the disk space of discarded bytes is released (by punching a hole in the file) every PunchThreshold
+// bytes, so a buffer which never drains (ex. with a lagging reader) doesn't use ever more disk space, though the
+// file's apparent size still grows. On other platforms, or file systems which can't punch holes, discarded
+// bytes stay in the file until it's drained.
+type FileWriter struct {
+	f         *os.File
+	off, roff int64 // write offset and oldest retained byte in the file
+	punched   int64 // the disk space of the file before this offset has been released
+	nopunch   bool  // punching holes failed, stop trying
+	temp      bool  // remove the file on Close
+}
+
+// PunchThreshold is how many discarded bytes a FileWriter waits for before releasing their disk space.
+const PunchThreshold = 1 << 20
+
+// NewFileWriter returns a new FileWriter which stores bytes in the file at path, it's created if
+// it doesn't exist and truncated if it does.
+func NewFileWriter(path string) (*FileWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileWriter{f: f}, nil
+}
+
+// NewTempFileWriter returns a new FileWriter which stores bytes in a new temporary file in dir
+// (or the default temp directory if dir is empty), the file is removed on Close.
+func NewTempFileWriter(dir string) (*FileWriter, error) {
+	f, err := ioutil.TempFile(dir, "bufit")
+	if err != nil {
+		return nil, err
+	}
+	return &FileWriter{f: f, temp: true}, nil
+}
+
+// Len returns the # of bytes buffered for Readers.
+func (w *FileWriter) Len() int {
+	return int(w.off - w.roff)
+}
+
+// Discard drops up to s buffered bytes, it returns io.EOF if the buffer was fully drained.
+func (w *FileWriter) Discard(s int) (n int, err error) {
+	if l := w.Len(); s > l {
+		s = l
+	} else if s < 0 {
+		s = 0
+	}
+	w.roff += int64(s)
+	if s > 0 && w.roff == w.off {
+		// every snapshot has been read, reuse the file from the start
+		w.off, w.roff, w.punched = 0, 0, 0
+		if terr := w.f.Truncate(0); terr != nil {
+			return s, terr
+		}
+		err = io.EOF
+	} else if !w.nopunch && w.roff-w.punched >= PunchThreshold {
+		// readers only hold snapshots of retained bytes, so the discarded ones can be released
+		if perr := punchHole(w.f, w.punched, w.roff-w.punched); perr != nil {
+			w.nopunch = true
+		} else {
+			w.punched = w.roff
+		}
+	}
+	return s, err
+}
+
+// Truncate drops the last s written bytes, it returns the # of bytes actually dropped.
+func (w *FileWriter) Truncate(s int) (n int, err error) {
+	if l := w.Len(); s > l {
+		s = l
+	}
+	if s > 0 {
+		w.off -= int64(s)
+	}
+	return s, nil
+}
+
+// Write appends p to the file.
+func (w *FileWriter) Write(p []byte) (n int, err error) {
+	n, err = w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// NextReader returns a Reader of the bytes currently buffered.
+func (w *FileWriter) NextReader() Reader {
+	return &fileReader{f: w.f, off: w.roff, end: w.off}
+}
+
+// Sync commits the written bytes to stable storage, see Flushable.
+func (w *FileWriter) Sync() error {
+	return w.f.Sync()
+}
+
+// Close closes the file, and removes it if it's a temporary file. The Buffer must not be used afterwards.
+func (w *FileWriter) Close() error {
+	err := w.f.Close()
+	if w.temp {
+		if rerr := os.Remove(w.f.Name()); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+type fileReader struct {
+	f        io.ReaderAt
+	off, end int64
+}
+
+func (r *fileReader) Len() int {
+	return int(r.end - r.off)
+}
+
+func (r *fileReader) Discard(s int) (n int, err error) {
+	if l := r.Len(); s > l {
+		s = l
+	} else if s < 0 {
+		s = 0
+	}
+	if r.off += int64(s); r.off == r.end {
+		err = io.EOF
+	}
+	return s, err
+}
+
+func (r *fileReader) Truncate(s int) (n int, err error) {
+	if l := r.Len(); s > l {
+		s = l
+	}
+	if s > 0 {
+		r.end -= int64(s)
+	}
+	return s, nil
+}
+
+func (r *fileReader) Read(p []byte) (n int, err error) {
+	if r.off == r.end {
+		return 0, io.EOF
+	} else if l := r.Len(); len(p) > l {
+		p = p[:l]
+	}
+	n, err = r.f.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+package bufit
+
+import (
+	"io"
+	"sync"
+)
+
+// Group is a set of readers which share a single position in the Buffer, every byte is read by only
+// one of the Group's readers. This allows a pool of workers to collectively consume the buffer,
+// rather than each getting a full copy of it.
+// The Group holds its place in the Buffer like a reader returned by NextReader until it's closed.
+type Group struct {
+	mu sync.Mutex
+	r  *BufferReader
+}
+
+// NewReaderGroup returns a new Group which starts reading at the same position NextReader would.
+func (b *Buffer) NewReaderGroup() *Group {
+	return &Group{r: b.NextBufferReader()}
+}
+
+// NextReader returns a new io.ReadCloser which reads from the Group's shared position.
+// Reads from the Group's readers are serialized, each Read returns the next bytes which haven't been
+// read by any of the Group's readers. Closing the returned reader only stops that reader.
+func (g *Group) NextReader() io.ReadCloser {
+	return &groupReader{g: g}
+}
+
+// Close drops the Group's place in the Buffer, all of its readers will return io.EOF.
+func (g *Group) Close() error {
+	return g.r.Close()
+}
+
+type groupReader struct {
+	g *Group
+	life
+}
+
+func (r *groupReader) Read(p []byte) (int, error) {
+	if !r.alive() {
+		return 0, io.EOF
+	}
+	r.g.mu.Lock()
+	defer r.g.mu.Unlock()
+	return r.g.r.Read(p)
+}
+
+func (r *groupReader) Close() error {
+	r.kill()
+	return nil
+}
+
+// SyncReader is a BufferReader whose methods are safe to call from multiple goroutines.
+// Concurrent Reads are serialized, so each one returns a distinct range of the Buffer.
+type SyncReader struct {
+	mu sync.Mutex
+	r  *BufferReader
+}
+
+// NextSyncReader returns a new SyncReader which starts reading at the same position NextReader would.
+func (b *Buffer) NextSyncReader() *SyncReader {
+	return &SyncReader{r: b.NextBufferReader()}
+}
+
+// Read reads the next bytes which haven't been read by any other caller of this SyncReader.
+func (r *SyncReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Read(p)
+}
+
+// Close drops the SyncReader's place in the Buffer, a blocked Read and following Reads return io.EOF.
+// It doesn't wait for a blocked Read, so it can be used to cancel one.
+func (r *SyncReader) Close() error {
+	return r.r.Close() // safe to call concurrently with Read
+}
+
+// NextTeeReader returns a new io.ReadCloser which starts reading at the same position NextReader would,
+// and writes every byte it reads to w before returning it, like io.TeeReader. If writing to w fails, Read
+// returns the bytes it read along with w's error. Close drops the reader's place in the Buffer.
+func (b *Buffer) NextTeeReader(w io.Writer) io.ReadCloser {
+	return &teeReader{r: b.NextBufferReader(), w: w}
+}
+
+type teeReader struct {
+	r *BufferReader
+	w io.Writer
+}
+
+func (t *teeReader) Read(p []byte) (n int, err error) {
+	n, err = t.r.Read(p)
+	if n > 0 {
+		if wn, werr := t.w.Write(p[:n]); werr != nil {
+			return n, werr
+		} else if wn < n {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, err
+}
+
+func (t *teeReader) Close() error {
+	return t.r.Close()
+}
@@ -0,0 +1,76 @@
+//go:build bufitdebug
+// +build bufitdebug
+
+package bufit
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"sync"
+)
+
+// IntegrityTracking makes the buffer keep a running hash of every byte written to it, and every reader
+// which starts at the very beginning of the stream a running hash of every byte it reads. When such a reader
+// is closed after reading the whole stream, and wasn't advanced by SetMaxLag or SetMaxReaderAge, it panics
+// if its hash doesn't match the stream's. It's a debugging aid for catching lost or corrupted data, and adds
+// a hash of every byte written and read. It must be called before the first Write, otherwise it does nothing,
+// and Truncate stops it since the bytes can't be removed from the stream's hash.
+// It's only available when built with the bufitdebug tag (ex. go test -tags bufitdebug), other builds don't hash.
+func (b *Buffer) IntegrityTracking() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.wsum == nil && b.off+b.buf.Len() == 0 {
+		b.wsum = fnv.New64a()
+	}
+}
+
+// readSum is a reader's running hash of the bytes it read.
+type readSum struct {
+	mu  sync.Mutex
+	sum hash.Hash64
+}
+
+// hashWrite adds written bytes to the stream's hash. b.mu must be held.
+func (b *Buffer) hashWrite(p []byte) {
+	if b.wsum != nil {
+		b.wsum.Write(p)
+	}
+}
+
+// track starts hashing what r reads if it starts at the beginning of a tracked stream. b.mu must be held.
+func (b *Buffer) track(r *BufferReader) {
+	if b.wsum != nil && r.off == 0 {
+		r.rsum = &readSum{sum: fnv.New64a()}
+	}
+}
+
+// hashRead adds bytes r read to its hash.
+func (r *BufferReader) hashRead(p []byte) {
+	if r.rsum != nil {
+		r.rsum.mu.Lock()
+		r.rsum.sum.Write(p)
+		r.rsum.mu.Unlock()
+	}
+}
+
+// verify panics if r read the whole stream but its hash doesn't match the stream's.
+// r must already be closed or deferred to be, so a panic doesn't leave it holding the buffer.
+func (r *BufferReader) verify() {
+	if r.rsum == nil {
+		return
+	}
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.rsum.mu.Lock()
+	defer r.rsum.mu.Unlock()
+
+	read, written := r.BytesRead(), int64(b.off+b.buf.Len())
+	if b.wsum == nil || read != written || r.dropped > 0 {
+		return
+	}
+	if got, want := r.rsum.sum.Sum64(), b.wsum.Sum64(); got != want {
+		panic(fmt.Sprintf("bufit: integrity check failed, reader read all %d bytes with hash %016x but they were written with hash %016x", read, got, want))
+	}
+}
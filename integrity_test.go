@@ -0,0 +1,79 @@
+//go:build bufitdebug
+// +build bufitdebug
+
+package bufit
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestIntegrityTracking(t *testing.T) {
+	data, _ := ioutil.ReadAll(io.LimitReader(rand.Reader, 64*1024))
+	buf := NewCapped(1024) // wraps the ring many times
+	buf.IntegrityTracking()
+	rs := buf.NextReaders(3)
+	go func() {
+		for p := data; len(p) > 0; p = p[100:] {
+			if len(p) < 100 {
+				buf.Write(p)
+				break
+			}
+			buf.Write(p[:100])
+		}
+		buf.Close()
+	}()
+
+	var grp sync.WaitGroup
+	grp.Add(3)
+	go func() {
+		defer grp.Done()
+		io.Copy(ioutil.Discard, rs[0])
+	}()
+	go func() {
+		defer grp.Done()
+		rs[1].CopyBufferTo(ioutil.Discard, nil)
+	}()
+	go func() {
+		defer grp.Done()
+		for {
+			if _, err := rs[2].Discard(77); err != nil {
+				return
+			}
+		}
+	}()
+	grp.Wait()
+	for i, r := range rs {
+		if n := r.BytesRead(); n != int64(len(data)) {
+			t.Errorf("expected reader %d to read all %d bytes got %d", i, len(data), n)
+		}
+		r.Close() // panics on a mismatch
+	}
+
+	buf = New()
+	buf.IntegrityTracking()
+	r := buf.NextReader()
+	io.WriteString(buf, "hello world")
+	buf.Close()
+	buf.mu.Lock()
+	buf.buf.(*writer).data[4] = '0' // corrupt the stream
+	buf.mu.Unlock()
+	if data, _ := ioutil.ReadAll(r); string(data) != "hell0 world" {
+		t.Fatalf("expected the corrupted hell0 world got %q", data)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected closing the reader to panic on the corrupted read")
+		}
+		assertNumReaders(0, buf, t) // the panic doesn't leave the reader holding the buffer
+		select {
+		case <-r.(*BufferReader).Done():
+		default:
+			t.Error("expected the reader to be closed")
+		}
+	}()
+	r.Close()
+}
@@ -0,0 +1,225 @@
+//go:build go1.21
+// +build go1.21
+
+package bufit
+
+import (
+	"io"
+	"sync"
+)
+
+// ItemBuffer is a Buffer of items of type T rather than bytes, so a stream of structured values (ex. events)
+// can be fanned out to multiple readers. Like a Buffer, every reader sees every item written after it joined,
+// a reader from NextReader also sees the items still retained from before it joined, items are kept until
+// all readers have read them, and writes block while a capped buffer is full.
+// Items are copied into the buffer, so a T holding pointers shares what they point to with every reader.
+// ItemBuffer needs generics, it's only built by Go 1.21 or later (the first release which builds generic code
+// in a module whose go.mod predates them), the rest of the package still supports older versions.
+type ItemBuffer[T any] struct {
+	mu      sync.Mutex
+	rwait   *sync.Cond
+	wwait   *sync.Cond
+	ring    []T
+	head    int // index of the oldest item in ring
+	n       int // # of items in ring
+	off     int // absolute offset of the oldest item
+	cap     int
+	readers map[*ItemReader[T]]struct{}
+	closed  bool
+}
+
+// NewItemBuffer creates a new ItemBuffer which holds at most cap items, a cap <= 0 doesn't limit it.
+func NewItemBuffer[T any](cap int) *ItemBuffer[T] {
+	if cap < 0 {
+		cap = 0
+	}
+	b := &ItemBuffer[T]{
+		ring:    make([]T, cap),
+		cap:     cap,
+		readers: make(map[*ItemReader[T]]struct{}),
+	}
+	b.rwait = sync.NewCond(&b.mu)
+	b.wwait = sync.NewCond(&b.mu)
+	return b
+}
+
+// Len returns the # of items currently retained by the buffer.
+func (b *ItemBuffer[T]) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// Snapshot returns a copy of the items currently retained by the buffer, without creating a reader or
+// affecting eviction.
+func (b *ItemBuffer[T]) Snapshot() []T {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := make([]T, b.n)
+	b.copyFrom(p, b.off)
+	return p
+}
+
+// Write appends items to the buffer, blocking while the buffer is at its cap until readers make room.
+// It returns the # of items written, which is less than len(items) only if the buffer was closed mid-write,
+// writes after Close return io.ErrClosedPipe.
+func (b *ItemBuffer[T]) Write(items []T) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for n < len(items) {
+		if b.closed {
+			return n, io.ErrClosedPipe
+		}
+		if b.cap > 0 && b.n >= b.cap {
+			b.wwait.Wait()
+			continue
+		}
+
+		m := len(items) - n
+		if b.cap > 0 && b.cap-b.n < m {
+			m = b.cap - b.n
+		}
+		b.push(items[n : n+m])
+		n += m
+		b.rwait.Broadcast()
+	}
+	return n, nil
+}
+
+// push appends items to the ring, growing it if it's too small. b.mu must be held.
+func (b *ItemBuffer[T]) push(items []T) {
+	if b.n+len(items) > len(b.ring) {
+		size := 2 * len(b.ring)
+		if size < b.n+len(items) {
+			size = b.n + len(items)
+		}
+		ring := make([]T, size)
+		b.copyFrom(ring, b.off)
+		b.ring, b.head = ring, 0
+	}
+
+	tail := (b.head + b.n) % len(b.ring)
+	m := copy(b.ring[tail:], items)
+	copy(b.ring, items[m:])
+	b.n += len(items)
+}
+
+// copyFrom copies the items starting at absolute offset off into p, it returns the # of items copied.
+// b.mu must be held.
+func (b *ItemBuffer[T]) copyFrom(p []T, off int) int {
+	avail := b.off + b.n - off
+	if len(p) > avail {
+		p = p[:avail]
+	}
+	if len(p) == 0 {
+		return 0
+	}
+
+	start := (b.head + off - b.off) % len(b.ring)
+	m := copy(p, b.ring[start:])
+	copy(p[m:], b.ring)
+	return len(p)
+}
+
+// evict drops the items which every reader has read, clearing them so they can be garbage collected.
+// Like a Buffer, items are kept while there are no readers. b.mu must be held.
+func (b *ItemBuffer[T]) evict() {
+	if len(b.readers) == 0 {
+		return
+	}
+	low := b.off + b.n
+	for r := range b.readers {
+		if r.off < low {
+			low = r.off
+		}
+	}
+
+	var zero T
+	for ; b.off < low; b.off++ {
+		b.ring[b.head] = zero
+		b.head = (b.head + 1) % len(b.ring)
+		b.n--
+	}
+	b.wwait.Broadcast()
+}
+
+// NextReader returns a new ItemReader which starts reading at the oldest item retained by the buffer.
+func (b *ItemBuffer[T]) NextReader() *ItemReader[T] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.join(b.off)
+}
+
+// NextReaderFromNow returns a new ItemReader which starts reading at the next item written to the buffer.
+func (b *ItemBuffer[T]) NextReaderFromNow() *ItemReader[T] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.join(b.off + b.n)
+}
+
+// join adds a reader starting at absolute offset off. b.mu must be held.
+// Items are kept while there are no readers, so the first reader may release items a blocked Write waits on.
+func (b *ItemBuffer[T]) join(off int) *ItemReader[T] {
+	r := &ItemReader[T]{buf: b, off: off}
+	b.readers[r] = struct{}{}
+	b.evict()
+	return r
+}
+
+// Close closes the buffer, writes fail with io.ErrClosedPipe and readers return io.EOF once they've read
+// every item written. It always returns nil.
+func (b *ItemBuffer[T]) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.rwait.Broadcast()
+	b.wwait.Broadcast()
+	return nil
+}
+
+// ItemReader reads items from an ItemBuffer, it's returned by ItemBuffer.NextReader and
+// ItemBuffer.NextReaderFromNow. Its methods are safe to call concurrently with the ItemBuffer's methods,
+// but not with each other.
+type ItemReader[T any] struct {
+	buf    *ItemBuffer[T]
+	off    int
+	closed bool
+}
+
+// Read reads the next items of the buffer into p, blocking while the buffer is open and has no new items.
+// It returns io.EOF once r is closed, or the buffer is closed and r has read every item.
+func (r *ItemReader[T]) Read(p []T) (n int, err error) {
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for r.off == b.off+b.n && !b.closed && !r.closed {
+		b.rwait.Wait()
+	}
+	if r.closed {
+		return 0, io.EOF
+	}
+
+	n = b.copyFrom(p, r.off)
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	r.off += n
+	b.evict()
+	return n, nil
+}
+
+// Close drops r's place in the buffer, releasing the items it hadn't read, its Reads return io.EOF.
+// It always returns nil.
+func (r *ItemReader[T]) Close() error {
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	delete(b.readers, r)
+	b.evict()
+	b.rwait.Broadcast()
+	return nil
+}
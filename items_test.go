@@ -0,0 +1,132 @@
+//go:build go1.21
+// +build go1.21
+
+package bufit
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type event struct {
+	id   int
+	name string
+}
+
+func readItems[T any](r *ItemReader[T]) (items []T, err error) {
+	p := make([]T, 3)
+	for {
+		n, err := r.Read(p)
+		items = append(items, p[:n]...)
+		if err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return items, err
+		}
+	}
+}
+
+func TestItemBuffer(t *testing.T) {
+	buf := NewItemBuffer[event](4)
+	early := buf.NextReader()
+	buf.Write([]event{{1, "a"}, {2, "b"}})
+	late := buf.NextReader()
+	now := buf.NextReaderFromNow()
+
+	var wg sync.WaitGroup
+	got := make([][]event, 3)
+	for i, r := range []*ItemReader[event]{early, late, now} {
+		wg.Add(1)
+		go func(i int, r *ItemReader[event]) {
+			defer wg.Done()
+			defer r.Close()
+			got[i], _ = readItems(r)
+		}(i, r)
+	}
+
+	// more items than the cap, so the write blocks until the readers make room
+	if n, err := buf.Write([]event{{3, "c"}, {4, "d"}, {5, "e"}, {6, "f"}, {7, "g"}}); n != 5 || err != nil {
+		t.Errorf("expected 5, nil got %d, %v", n, err)
+	}
+	buf.Close()
+	wg.Wait()
+
+	for i, want := range []int{7, 7, 5} {
+		if len(got[i]) != want || got[i][len(got[i])-1].id != 7 {
+			t.Errorf("reader %d: expected %d items ending with 7 got %v", i, want, got[i])
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected every item to be evicted got %d", buf.Len())
+	}
+	if _, err := buf.Write([]event{{8, "h"}}); err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe got %v", err)
+	}
+}
+
+func TestItemBufferEviction(t *testing.T) {
+	buf := NewItemBuffer[*event](0)
+	defer buf.Close()
+	buf.Write([]*event{{1, "a"}, {2, "b"}, {3, "c"}})
+	if s := buf.Snapshot(); len(s) != 3 || s[0].id != 1 {
+		t.Errorf("expected the items to be kept without readers got %v", s)
+	}
+
+	slow, fast := buf.NextReader(), buf.NextReader()
+	defer slow.Close()
+	defer fast.Close()
+	fast.Read(make([]*event, 3))
+	if buf.Len() != 3 {
+		t.Errorf("expected the slow reader to hold the items got %d", buf.Len())
+	}
+	slow.Read(make([]*event, 2))
+	if s := buf.Snapshot(); len(s) != 1 || s[0].id != 3 {
+		t.Errorf("expected only the item the slow reader hasn't read got %v", s)
+	}
+
+	done := make(chan int)
+	go func() {
+		n, _ := fast.Read(make([]*event, 1))
+		done <- n
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected Read to block without new items")
+	case <-time.After(10 * time.Millisecond):
+	}
+	buf.Write([]*event{{4, "d"}})
+	if n := <-done; n != 1 {
+		t.Errorf("expected 1 item got %d", n)
+	}
+}
+
+func TestItemBufferJoinFromNow(t *testing.T) {
+	buf := NewItemBuffer[int](2)
+	defer buf.Close()
+	buf.Write([]int{1, 2}) // kept without readers, filling the buffer
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf.Write([]int{3})
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected Write to block on the full buffer")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	r := buf.NextReaderFromNow() // releases the items before it
+	defer r.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the reader joining to unblock the Write")
+	}
+	p := make([]int, 2)
+	if n, _ := r.Read(p); n != 1 || p[0] != 3 {
+		t.Errorf("expected to read [3] got %v", p[:n])
+	}
+}
@@ -0,0 +1,166 @@
+package bufit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrOffsetNotRetained is returned for a ReaderCheckpoint whose offset isn't in the buffer anymore
+// (or yet).
+var ErrOffsetNotRetained = errors.New("bufit: offset is not retained by the buffer")
+
+// ErrMalformedSnapshot is returned by UnmarshalBinary when the data wasn't returned by MarshalBinary.
+var ErrMalformedSnapshot = errors.New("bufit: malformed buffer snapshot")
+
+// MarshalBinary implements encoding.BinaryMarshaler, it encodes the bytes retained by the buffer along with
+// the offset of the first one in the stream written to it, so UnmarshalBinary can restore them at the same
+// offsets (ex. after a restart) and RestoreReaders can recreate the readers of a ReaderManifest taken with it.
+// Like Snapshot it doesn't create a reader or affect eviction, a Write which isn't visible to readers yet
+// (see CompleteWritesOnly) isn't included.
+func (b *Buffer) MarshalBinary() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.end() - b.off
+	p := make([]byte, binary.MaxVarintLen64+n)
+	h := binary.PutUvarint(p, uint64(b.off))
+	m, err := io.ReadFull(limit(b.buf.NextReader(), n), p[h:h+n])
+	return p[:h+m], err
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, it replaces the buffer's content with data returned
+// by MarshalBinary, starting at the same offset in the stream, so RestoreReaders can recreate readers at their
+// checkpointed offsets. Like Reset it keeps the buffer's settings and reopens it if it was closed, and returns
+// ErrActiveReaders if the buffer has open readers. The restored bytes are written even if they exceed the cap,
+// later writes wait until readers drain the buffer below it.
+func (b *Buffer) UnmarshalBinary(data []byte) error {
+	base, h := binary.Uvarint(data)
+	if h <= 0 || base > uint64(maxInt) {
+		return ErrMalformedSnapshot
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.rh) > 0 || b.draining {
+		return ErrActiveReaders
+	}
+	b.reset()
+	b.off, b.visible = int(base), int(base)
+	_, err := b.buf.Write(data[h:])
+	b.hashWrite(data[h:])
+	return err
+}
+
+// maxInt is the largest offset an int can hold.
+const maxInt = int(^uint(0) >> 1)
+
+// ReaderCheckpoint is the saved position of a reader, see Buffer.ReaderManifest.
+type ReaderCheckpoint struct {
+	// Offset is the absolute offset of the reader in the stream written to the Buffer.
+	Offset int64
+}
+
+// RestoreError reports which checkpoints RestoreReaders couldn't restore, it holds an error
+// (or nil) for every checkpoint passed to it.
+type RestoreError []error
+
+func (e RestoreError) Error() string {
+	var msgs []string
+	for i, err := range e {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("checkpoint %d: %v", i, err))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ReaderManifest returns a checkpoint for every open reader, which RestoreReaders can use to recreate them.
+// A checkpoint holds the offset of the next byte the reader will read, bytes it pushed back with UnreadByte
+// or UnreadRune are read again by the restored reader.
+func (b *Buffer) ReaderManifest() []ReaderCheckpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cps := make([]ReaderCheckpoint, len(b.rh))
+	for i, r := range b.rh {
+		cps[i] = ReaderCheckpoint{Offset: int64(r.off+r.size) - atomic.LoadInt64(&r.owned)}
+	}
+	return cps
+}
+
+// RestoreReaders creates a reader at the offset of each checkpoint, of this buffer or of the one it was
+// restored from by UnmarshalBinary. If a checkpoint's offset isn't in
+// the buffer its reader is nil, and a RestoreError is returned with ErrOffsetNotRetained for it. Like
+// NextReaderChecked, the reader gate and max readers may refuse a reader, in which case the RestoreError
+// holds their error for it.
+func (b *Buffer) RestoreReaders(cps []ReaderCheckpoint) ([]*BufferReader, error) {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rs := make([]*BufferReader, len(cps))
+	errs := make(RestoreError, len(cps))
+	failed := false
+	for i, cp := range cps {
+		off := int(cp.Offset)
+		if off < b.off || off > b.end() {
+			errs[i], failed = ErrOffsetNotRetained, true
+			continue
+		}
+		if rs[i], errs[i] = b.readerAt(off); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return rs, errs
+	}
+	return rs, nil
+}
+
+// NextReaderReplayFrom returns a reader for a client resuming at clientOffset, which replays up to
+// safetyMargin bytes before it so the client can dedupe them. The reader starts at start, the later of
+// clientOffset-safetyMargin and the oldest retained byte, so the client should discard the first
+// clientOffset-start bytes it reads.
+// If clientOffset was already evicted the reader starts at the oldest retained byte and ErrOffsetNotRetained
+// is returned with it, the client missed start-clientOffset bytes. If clientOffset is past the end of the
+// buffer, or the reader gate or max readers refuse it (see NextReaderChecked), the reader is nil.
+func (b *Buffer) NextReaderReplayFrom(clientOffset, safetyMargin int64) (r *BufferReader, start int64, err error) {
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if clientOffset > int64(b.end()) {
+		return nil, 0, ErrOffsetNotRetained
+	}
+	if safetyMargin < 0 {
+		safetyMargin = 0
+	}
+	start = clientOffset - safetyMargin
+	if start < int64(b.off) {
+		start = int64(b.off)
+	}
+	if clientOffset < int64(b.off) {
+		err = ErrOffsetNotRetained
+	}
+	r, rerr := b.readerAt(int(start))
+	if rerr != nil {
+		return nil, 0, rerr
+	}
+	return r, start, err
+}
+
+// readerAt joins a new reader at off, which must be retained by the buffer, unless the gate or max readers refuse it.
+func (b *Buffer) readerAt(off int) (*BufferReader, error) {
+	r := &BufferReader{
+		buf:  b,
+		off:  off,
+		size: b.end() - off,
+		data: b.buf.NextReader(),
+	}
+	r.data.Discard(off - b.off)
+	r.data = limit(r.data, b.end()-off)
+	if err := b.join(r, true); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,86 @@
+package bufit
+
+import (
+	"context"
+	"time"
+)
+
+// pressurePoll is how often a write waiting on memory pressure checks if it has cleared.
+const pressurePoll = 10 * time.Millisecond
+
+// minShrink is the smallest allocation shrink reallocates, smaller ones aren't worth it so evictions don't
+// consult the pressure for them.
+const minShrink = 4 << 10
+
+// SetMemoryPressureFunc registers pressure to be consulted before the buffer grows its memory, so it can take
+// part in a process-wide memory governor (ex. one driven by runtime.ReadMemStats or a cgroup limit).
+// While pressure returns true a write which would grow the buffer waits until it fits in the memory already
+// allocated, or the pressure clears, and evictions shrink the buffer's memory once it's mostly empty.
+// Writes to a buffer without readers don't wait, since no reader can free memory for them.
+// pressure is called with the Buffer locked, so it must be cheap and must not call the Buffer's methods.
+// A panic in pressure is passed to the panic handler (see SetPanicHandler) and counts as no pressure.
+// A nil pressure disables this. It only applies to Writers returned by NewMemoryWriter.
+func (b *Buffer) SetMemoryPressureFunc(pressure func() bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pressure = pressure
+	b.wwait.Broadcast()
+}
+
+// pressured returns whether writing s bytes would grow the buffer while under memory pressure, and readers
+// could make room for it. b.mu must be held.
+func (b *Buffer) pressured(s int) bool {
+	w, ok := b.buf.(*writer)
+	if !ok || b.pressure == nil || len(b.rh) == 0 || w.Cap()-w.Len() >= s {
+		return false
+	}
+	return b.underPressure()
+}
+
+// underPressure consults the pressure func, a panic in it counts as no pressure. b.mu must be held.
+func (b *Buffer) underPressure() (p bool) {
+	b.call(func() { p = b.pressure() })
+	return p
+}
+
+// waitForMemory waits while writing s bytes would grow the buffer under memory pressure, it returns
+// whether it waited and false for ok if it gave up because ctx is done. b.mu must be held.
+func (b *Buffer) waitForMemory(ctx context.Context, s int) (waited, ok bool) {
+	if !b.pressured(s) {
+		return false, true
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() { // the pressure can clear without the buffer changing
+		t := time.NewTicker(pressurePoll)
+		defer t.Stop()
+		canceled := ctx.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			case <-canceled:
+				canceled = nil // only wake the writer once for it
+			}
+			b.mu.Lock()
+			b.wwait.Broadcast()
+			b.mu.Unlock()
+		}
+	}()
+
+	for b.alive() && ctx.Err() == nil && b.pressured(s) {
+		b.wwait.Wait()
+	}
+	return true, !(ctx.Err() != nil && b.alive() && b.pressured(s))
+}
+
+// shrink reallocates a mostly empty buffer to a smaller array under memory pressure. b.mu must be held.
+func (b *Buffer) shrink() {
+	w, ok := b.buf.(*writer)
+	if !ok || b.pressure == nil || w.Cap() < minShrink || w.Len() > w.Cap()/4 || !b.underPressure() {
+		return
+	}
+	*w = *w.realloc(w.Len() * 2)
+}
@@ -0,0 +1,252 @@
+package bufit
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoMessages is returned by ReadMessage when the Buffer isn't tracking message boundaries.
+var ErrNoMessages = errors.New("bufit: message boundaries are not enabled")
+
+// MessageBoundaries makes the buffer record where each Write ends, so readers can use
+// ReadMessage to read back the same chunks which were written. The byte stream itself is unchanged.
+// A Write which is split up while blocking on the cap is still a single message, unless another
+// Write adds bytes while it's blocked.
+// It should be called before the first Write, earlier writes aren't tracked.
+func (b *Buffer) MessageBoundaries() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = true
+}
+
+// boundary is the end offset of a message and the id of the producer which wrote it.
+type boundary struct {
+	end, id int
+}
+
+// WriteFrom is like Write, but tags the message with the producer id which ReadMessageFrom returns.
+// If a Write blocks on the cap and another producer writes in the meantime, the blocked Write is ended
+// early and its remainder becomes a separate message, so no message contains bytes of two producers.
+func (b *Buffer) WriteFrom(id int, p []byte) (n int, err error) {
+	n, _, err = b.writeDefault(id, p)
+	return n, err
+}
+
+// openMessage is called before the write tok (from producer id) writes more bytes, it ends the message
+// of any other write which is still open. b.mu must be held.
+func (b *Buffer) openMessage(tok uint64, id int) {
+	if !b.tracking() {
+		return
+	}
+	if b.msgTok != 0 && b.msgTok != tok {
+		b.endMessage(b.msgID)
+	}
+	b.msgTok, b.msgID = tok, id
+}
+
+// closeMessage ends the message of the write tok if it's still open, b.mu must be held.
+func (b *Buffer) closeMessage(tok uint64) {
+	if b.msgTok == tok {
+		b.endMessage(b.msgID)
+	}
+}
+
+// AlignedEviction makes the buffer only evict whole messages, so the retained data always starts on a
+// message boundary even if the slowest reader is part way through a message. It requires MessageBoundaries.
+// A capped buffer which is full still evicts part of a message, so a message larger than the cap can be written.
+func (b *Buffer) AlignedEviction() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.aligned = true
+}
+
+// alignedEnd returns the last message boundary at or before off, or b.off if there isn't one. b.mu must be held.
+func (b *Buffer) alignedEnd(off int) int {
+	end := b.off
+	for _, e := range b.ends {
+		if e.end > off {
+			break
+		}
+		end = e.end
+	}
+	return end
+}
+
+// endMessage records the current end of the buffer as a message boundary, b.mu must be held.
+func (b *Buffer) endMessage(id int) {
+	b.msgTok = 0
+	if !b.tracking() {
+		return
+	}
+	if end := b.off + b.buf.Len(); len(b.ends) == 0 || b.ends[len(b.ends)-1].end < end {
+		b.ends = append(b.ends, boundary{end: end, id: id})
+	}
+}
+
+// tracking returns whether message boundaries are recorded, b.mu must be held.
+func (b *Buffer) tracking() bool {
+	return b.messages || b.writeReaders > 0
+}
+
+// evictMessages drops boundaries of messages which have been evicted, b.mu must be held.
+func (b *Buffer) evictMessages() {
+	i := 0
+	for i < len(b.ends) && b.ends[i].end <= b.off {
+		i++
+	}
+	b.ends = b.ends[i:]
+}
+
+// truncateMessages drops boundaries past the end of the buffer after a Truncate,
+// the last (partially) truncated message now ends at the end of the buffer. b.mu must be held.
+func (b *Buffer) truncateMessages() {
+	end := b.off + b.buf.Len()
+	i := len(b.ends)
+	for i > 0 && b.ends[i-1].end > end {
+		i--
+	}
+	if i < len(b.ends) {
+		id := b.ends[i].id
+		b.ends = b.ends[:i]
+		b.endMessage(id)
+	}
+}
+
+// messageEnd returns r's position and the first message boundary after it within r's current snapshot,
+// with an end of -1 if there isn't one. A boundary at r's position counts if r is part way through a message.
+func (b *Buffer) messageEnd(r *BufferReader, started bool) (pos int, end boundary) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pos = r.pos()
+	for _, end := range b.ends {
+		if after := end.end > pos || started && end.end == pos; after && end.end <= r.off+r.size {
+			return pos, end
+		} else if after {
+			break
+		}
+	}
+	return pos, boundary{end: -1}
+}
+
+// ReadMessage reads the rest of the current message, which is exactly one Write when the reader
+// is at a message boundary. It blocks until the whole message is available. If the buffer is closed
+// it returns the bytes read with io.EOF. The Buffer must have called MessageBoundaries.
+func (r *BufferReader) ReadMessage() (msg []byte, err error) {
+	msg, _, err = r.ReadMessageFrom()
+	return msg, err
+}
+
+// ReadMessageFrom is like ReadMessage, but also returns the id of the producer which wrote the message
+// with WriteFrom (0 for Write). If the buffer is closed before the message ends, id is 0.
+func (r *BufferReader) ReadMessageFrom() (msg []byte, id int, err error) {
+	r.buf.mu.Lock()
+	messages := r.buf.messages
+	r.buf.mu.Unlock()
+	if !messages {
+		return nil, 0, ErrNoMessages
+	}
+	return r.readMessage()
+}
+
+// readMessage is ReadMessageFrom, without checking whether boundaries are recorded.
+func (r *BufferReader) readMessage() (msg []byte, id int, err error) {
+	if err = r.lost(); err != nil {
+		return nil, 0, err
+	}
+	r.prev = nil
+	msg = r.heldCopy() // held bytes are part of the current message
+	r.back, r.partial = nil, r.partial[:0]
+	r.settle()
+	for {
+		// boundaries inside the current snapshot are always recorded before it's fetched
+		if pos, end := r.buf.messageEnd(r, len(msg) > 0); end.end >= 0 {
+			p := make([]byte, end.end-pos)
+			n, _ := r.consume(p)
+			return append(msg, p[:n]...), end.id, nil
+		}
+
+		if r.data.Len() > 0 {
+			p := make([]byte, r.data.Len())
+			n, _ := r.consume(p)
+			msg = append(msg, p[:n]...)
+		} else if err = r.refill(); err != nil {
+			return msg, 0, err
+		}
+	}
+}
+
+// ReadMessages reads up to max messages like ReadMessage, it blocks until the first message is available
+// but only returns more messages if they're already complete in the buffer. If the buffer is closed and
+// the last message has been read, the final batch is returned with io.EOF.
+func (r *BufferReader) ReadMessages(max int) (msgs [][]byte, err error) {
+	for len(msgs) < max {
+		if len(msgs) > 0 {
+			if ready, eof := r.buf.messageReady(r); eof {
+				return msgs, r.eof()
+			} else if !ready {
+				break
+			}
+		}
+
+		msg, err := r.ReadMessage()
+		if len(msg) > 0 || err == nil {
+			msgs = append(msgs, msg)
+		}
+		if err != nil {
+			return msgs, err
+		}
+	}
+	return msgs, nil
+}
+
+// messageReady returns whether the rest of r's current message is in the buffer, and whether r has
+// read everything from the closed buffer.
+func (b *Buffer) messageReady(r *BufferReader) (ready, eof bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pos, end := r.pos(), b.end()
+	for _, e := range b.ends {
+		if e.end > pos {
+			return e.end <= end, false
+		}
+	}
+	return false, !b.alive() && pos == end
+}
+
+// WriteReader reads back the buffer one Write at a time, see Buffer.NextReaderWrites.
+type WriteReader struct {
+	r    *BufferReader
+	once sync.Once
+}
+
+// NextReaderWrites returns a reader whose NextWrite returns the bytes of one Write at a time, without
+// needing MessageBoundaries. Write boundaries are only recorded while such readers are open, so it
+// starts at the end of the buffer like NextReaderFromNow. A Write split up while blocking on the cap
+// is still returned whole, as with ReadMessage. Close the WriteReader to stop tracking boundaries for it.
+func (b *Buffer) NextReaderWrites() *WriteReader {
+	b.mu.Lock()
+	b.writeReaders++
+	b.mu.Unlock()
+	return &WriteReader{r: b.NextBufferReaderFromNow()}
+}
+
+// NextWrite returns the rest of the next Write, blocking until all of it is available.
+// If the buffer is closed it returns the bytes read with io.EOF.
+func (w *WriteReader) NextWrite() ([]byte, error) {
+	msg, _, err := w.r.readMessage()
+	return msg, err
+}
+
+// Close closes the WriteReader's reader, if it's the last WriteReader and the Buffer doesn't
+// record MessageBoundaries it stops recording write boundaries.
+func (w *WriteReader) Close() error {
+	w.once.Do(func() {
+		b := w.r.buf
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.writeReaders--; !b.tracking() {
+			b.ends = nil
+		}
+	})
+	return w.r.Close()
+}
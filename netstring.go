@@ -0,0 +1,80 @@
+package bufit
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// ErrMalformedNetstring is returned by ReadNetstring when the data isn't a valid netstring.
+var ErrMalformedNetstring = errors.New("bufit: malformed netstring")
+
+// maxNetstringDigits limits the length prefix to something which fits in an int on all platforms.
+const maxNetstringDigits = 9
+
+// DefaultMaxNetstring is the max netstring size ReadNetstring accepts unless it's changed by SetMaxNetstring.
+const DefaultMaxNetstring = 4 << 20
+
+// SetMaxNetstring sets the max netstring size ReadNetstring accepts, so a corrupt or hostile length prefix can't
+// make it allocate an arbitrary amount of memory. n <= 0 resets it to DefaultMaxNetstring.
+func (r *BufferReader) SetMaxNetstring(n int) {
+	r.maxNetstr = n
+}
+
+func (r *BufferReader) maxNetstringSize() int {
+	if r.maxNetstr <= 0 {
+		return DefaultMaxNetstring
+	}
+	return r.maxNetstr
+}
+
+// WriteNetstring writes p to the buffer as a single netstring write ("len:data,").
+// It returns the # of bytes of the netstring which were written.
+func (b *Buffer) WriteNetstring(p []byte) (int, error) {
+	frame := make([]byte, 0, len(p)+maxNetstringDigits+2)
+	frame = strconv.AppendInt(frame, int64(len(p)), 10)
+	frame = append(frame, ':')
+	frame = append(frame, p...)
+	frame = append(frame, ',')
+	return b.Write(frame)
+}
+
+// ReadNetstring reads the next netstring ("len:data,") and returns its data, blocking until all of it
+// is available. It returns io.EOF if the buffer ended before the netstring started, io.ErrUnexpectedEOF if
+// it ended part way through, ErrMalformedNetstring if the framing is invalid, or ErrFrameTooLarge if the length
+// is larger than the max netstring size, in which case the prefix is consumed but the data isn't.
+func (r *BufferReader) ReadNetstring() ([]byte, error) {
+	var c [1]byte
+	size, digits := 0, 0
+	for {
+		if _, err := io.ReadFull(readFunc(r.read), c[:]); err != nil {
+			if digits > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if c[0] == ':' && digits > 0 {
+			break
+		} else if c[0] < '0' || c[0] > '9' || digits == maxNetstringDigits || (digits == 1 && size == 0) {
+			return nil, ErrMalformedNetstring // not a digit, too long, or a leading zero
+		}
+		size = size*10 + int(c[0]-'0')
+		digits++
+	}
+	if size > r.maxNetstringSize() {
+		return nil, ErrFrameTooLarge
+	}
+
+	p := make([]byte, size+1)
+	if _, err := io.ReadFull(readFunc(r.read), p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if p[size] != ',' {
+		return nil, ErrMalformedNetstring
+	}
+	return p[:size], nil
+}
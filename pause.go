@@ -0,0 +1,54 @@
+package bufit
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrPaused is returned by writes to a paused buffer when PauseBlocksWrites(false) is set.
+var ErrPaused = errors.New("bufit: buffer is paused")
+
+// Pause stops the buffer from accepting writes until Resume is called, readers can still read
+// what's already in the buffer. Writes made while paused block until Resume, or fail with ErrPaused,
+// see PauseBlocksWrites.
+func (b *Buffer) Pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused = true
+}
+
+// Resume lets the buffer accept writes again after Pause, unblocking any waiting writers.
+func (b *Buffer) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused = false
+	b.wwait.Broadcast()
+}
+
+// PauseBlocksWrites sets whether writes made while the buffer is paused block until it's resumed (the default),
+// or return ErrPaused immediately so producers can shed load. A write paused partway returns the # of bytes written so far.
+func (b *Buffer) PauseBlocksWrites(block bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pauseFails = !block
+}
+
+// waitForResume waits while the buffer is paused until it's resumed, closed, or ctx is done, it returns ErrPaused
+// if writes shouldn't wait, or ctx.Err() if it stopped waiting because ctx is done. b.mu must be held.
+func (b *Buffer) waitForResume(ctx context.Context) error {
+	if !b.paused {
+		return nil
+	} else if b.pauseFails {
+		return ErrPaused
+	}
+	if ctx.Done() != nil {
+		defer b.wakeOnDone(ctx)()
+	}
+	for b.paused && b.alive() && ctx.Err() == nil {
+		b.wwait.Wait()
+	}
+	if ctx.Err() != nil && b.paused && b.alive() {
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package bufit
+
+import "io"
+
+// DuplexPipe returns two connected endpoints backed by a pair of Buffers, data written to a is read from b
+// and data written to b is read from a. Unlike net.Pipe, writes are buffered so they don't wait for the
+// peer to read them. Closing an endpoint only closes its write side, so its peer reads io.EOF once it has
+// read everything, while the closed endpoint may still read what its peer writes until the peer closes too.
+func DuplexPipe() (a, b io.ReadWriteCloser) {
+	ab, ba := New(), New()
+	return &duplex{r: ba.NextBufferReader(), w: ab}, &duplex{r: ab.NextBufferReader(), w: ba}
+}
+
+type duplex struct {
+	r *BufferReader
+	w *Buffer
+}
+
+func (d *duplex) Read(p []byte) (int, error)  { return d.r.Read(p) }
+func (d *duplex) Write(p []byte) (int, error) { return d.w.Write(p) }
+func (d *duplex) Close() error                { return d.w.Close() }
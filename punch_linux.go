@@ -0,0 +1,17 @@
+package bufit
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate modes from linux/falloc.h
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+// punchHole releases the disk space of n bytes of f at off, without changing the offsets of later bytes.
+func punchHole(f *os.File, off, n int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, off, n)
+}
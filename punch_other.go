@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package bufit
+
+import "os"
+
+// punchHole isn't supported on this platform, discarded bytes stay in the file until it's drained.
+func punchHole(f *os.File, off, n int64) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,1023 @@
+package bufit
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// BufferReader reads from a Buffer, it's returned by Buffer.NextBufferReader and Buffer.NextBufferReaderFromNow
+// (and as an io.ReadCloser by Buffer.NextReader and Buffer.NextReaderFromNow).
+// Its methods are safe to call concurrently with the Buffer's methods, but not with each other,
+// use Buffer.NextSyncReader for a reader which multiple goroutines can share.
+type BufferReader struct {
+	bytesRead int64 // first for 64-bit alignment of atomic ops
+	lastRead  int64 // UnixNano of r's last read from its snapshot or fetch, see SetMaxReaderAge
+	owned     int64 // bytes r took from the buffer but hasn't returned yet, see settle
+	canceled  int32 // # of readUntil calls whose cancel fired, until they return
+	expired   int32 // set once the read deadline has passed
+	skipped   int32 // set when the buffer dropped unread data to make room, until Read reports it
+	slow      int32 // set when the buffer closed r to make room
+	buf       *Buffer
+	i         int
+	off       int
+	start     int
+	size      int
+	data      Reader
+	dropped   int
+	record    int
+	maxFrame  int // see SetMaxVarintFrame
+	maxNetstr int // see SetMaxNetstring
+	nonblock  bool
+	timeout   time.Duration
+	dtimer    *time.Timer // expires the read deadline, guarded by buf.mu like dgen
+	dgen      int
+	reading   bool // set during Read, so only Read is interrupted by the deadline
+	ahead     int
+	partial   []byte
+	back      []byte // unread bytes, read again before the snapshot
+	prev      []byte // bytes of the last ReadByte or ReadRune, nil after other reads
+	prevRune  bool
+	waiting   bool
+	protected bool
+	closeOnce sync.Once
+	doneOnce  sync.Once
+	done      chan struct{}
+	rsum      *readSum // nil unless the buffer's IntegrityTracking applies to r
+	life
+}
+
+// Closed returns whether r has been closed. It's safe to call concurrently with all other methods.
+func (r *BufferReader) Closed() bool {
+	return !r.alive()
+}
+
+// Done returns a channel which is closed once r is closed. It's safe to call concurrently with all other methods.
+func (r *BufferReader) Done() <-chan struct{} {
+	r.doneOnce.Do(r.initDone)
+	return r.done
+}
+
+func (r *BufferReader) initDone() { r.done = make(chan struct{}) }
+
+// Dropped returns the # of bytes this reader skipped because it fell more than the buffer's max lag behind,
+// didn't read for longer than its max reader age, or held the oldest data in a full buffer which drops it,
+// see Buffer.SetMaxLag, Buffer.SetMaxReaderAge and DropSlowestReader.
+func (r *BufferReader) Dropped() int {
+	r.buf.mu.Lock()
+	defer r.buf.mu.Unlock()
+	return r.dropped
+}
+
+// IsLastReader returns whether r is the only open reader of its Buffer. This is inherently racy,
+// another reader may join right after it returns, so it's only useful for opportunistic decisions.
+func (r *BufferReader) IsLastReader() bool {
+	r.buf.mu.Lock()
+	defer r.buf.mu.Unlock()
+	return len(r.buf.rh) == 1 && r.buf.rh[0] == r
+}
+
+// BytesRead returns the total # of bytes this reader has consumed, by reading or discarding them.
+// It's safe to call concurrently with all other methods.
+func (r *BufferReader) BytesRead() int64 {
+	return atomic.LoadInt64(&r.bytesRead)
+}
+
+// RelativeTell returns r's current offset relative to where it started reading when it was created,
+// it counts bytes read, discarded and skipped. A reader from NextReaderFromNow starts at 0.
+func (r *BufferReader) RelativeTell() int64 {
+	r.buf.mu.Lock()
+	defer r.buf.mu.Unlock()
+	return int64(r.tell() - r.start)
+}
+
+// Len returns the # of bytes r can read right now without blocking, everything written to the buffer
+// which r hasn't read yet (not just what it has already taken from the buffer). It's 0 once r is closed.
+func (r *BufferReader) Len() int {
+	if !r.alive() {
+		return 0
+	}
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.end() - r.pos() + len(r.back) + len(r.partial)
+}
+
+// AtEOF returns whether the next Read would return io.EOF, because r was closed or because the buffer
+// was closed and r has read everything. It's always false while r and the buffer are open, since more
+// data may be written. It doesn't block or consume anything.
+func (r *BufferReader) AtEOF() bool {
+	if !r.alive() {
+		return true
+	}
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.alive() && len(r.back) == 0 && len(r.partial) == 0 && r.pos() == b.end()
+}
+
+// consume reads from r's snapshot, counting the bytes read.
+func (r *BufferReader) consume(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	r.settle()
+	r.hashRead(p[:n])
+	r.count(n)
+	return n, err
+}
+
+// settle records how many bytes r took from the buffer but hasn't returned yet (its unread snapshot and
+// held bytes), so the buffer can tell where r is without reading state r changes while it reads unlocked.
+// It must be called by r's reads after they change either.
+func (r *BufferReader) settle() {
+	atomic.StoreInt64(&r.owned, int64(r.data.Len()+len(r.back)+len(r.partial)))
+}
+
+// count adds n bytes to the bytes r read, and marks it as having just read if n > 0.
+func (r *BufferReader) count(n int) {
+	if n > 0 {
+		atomic.AddInt64(&r.bytesRead, int64(n))
+		r.touch()
+	}
+}
+
+// touch marks r as having just read, so SetMaxReaderAge doesn't expire it while it works through a snapshot.
+func (r *BufferReader) touch() {
+	atomic.StoreInt64(&r.lastRead, r.buf.now().UnixNano())
+}
+
+// skip discards from r's snapshot, counting the bytes discarded.
+func (r *BufferReader) skip(s int) (int, error) {
+	if r.rsum != nil { // hash what's skipped
+		return r.consume(make([]byte, s))
+	}
+	n, err := r.data.Discard(s)
+	r.settle()
+	r.count(n)
+	return n, err
+}
+
+// eof returns the error to return once r has read everything, which is the buffer's close error
+// unless r itself was closed.
+func (r *BufferReader) eof() error {
+	if r.alive() {
+		return r.buf.eof()
+	}
+	if atomic.LoadInt32(&r.slow) == 1 {
+		return ErrSlowReader
+	}
+	return io.EOF
+}
+
+// lost returns the error reads report instead of data after a full buffer made room at r's expense:
+// ErrSlowReader on every read once it closed r (see CloseSlowestReader), or ErrDropped once after it
+// dropped data r hadn't read (see DropSlowestReader). It's nil otherwise.
+func (r *BufferReader) lost() error {
+	if atomic.LoadInt32(&r.slow) == 1 {
+		return ErrSlowReader
+	}
+	if atomic.CompareAndSwapInt32(&r.skipped, 1, 0) {
+		return ErrDropped
+	}
+	return nil
+}
+
+// losing returns whether the next read will report lost, without clearing it.
+func (r *BufferReader) losing() bool {
+	return atomic.LoadInt32(&r.slow) == 1 || atomic.LoadInt32(&r.skipped) == 1
+}
+
+// refill blocks for r's next snapshot, it returns the error reads should report instead if r lost data
+// meanwhile, or if there's nothing left to read.
+func (r *BufferReader) refill() error {
+	r.buf.fetch(r, true)
+	if err := r.lost(); err != nil {
+		return err
+	}
+	if r.data.Len() == 0 {
+		return r.eof()
+	}
+	return nil
+}
+
+// pos returns the absolute offset of the next byte r will read from the buffer.
+func (r *BufferReader) pos() int {
+	return r.off + r.size - r.data.Len()
+}
+
+// tell returns the absolute offset of the next byte a Read returns, which is before pos while r holds bytes.
+func (r *BufferReader) tell() int {
+	return r.pos() - len(r.back) - len(r.partial)
+}
+
+// held returns the next bytes r holds outside of the buffer, which are read before it reads from the buffer again:
+// bytes pushed back by UnreadByte or UnreadRune, then a partial record held back by Read.
+func (r *BufferReader) held() []byte {
+	if len(r.back) > 0 {
+		return r.back
+	}
+	return r.partial
+}
+
+// dropHeld advances r past the first n bytes of held.
+func (r *BufferReader) dropHeld(n int) {
+	if len(r.back) > 0 {
+		r.back = r.back[n:]
+	} else {
+		r.partial = r.partial[n:]
+	}
+	r.settle()
+}
+
+// readHeld moves bytes r holds into p, it returns the # of bytes moved.
+func (r *BufferReader) readHeld(p []byte) (n int) {
+	for h := r.held(); n < len(p) && len(h) > 0; h = r.held() {
+		m := copy(p[n:], h)
+		r.dropHeld(m)
+		n += m
+	}
+	return n
+}
+
+// unhold puts p, the last bytes moved out of held, back in front of it.
+func (r *BufferReader) unhold(p []byte) {
+	if len(r.back) > 0 {
+		r.back = append(append([]byte(nil), p...), r.back...)
+	} else if len(r.partial) > 0 {
+		r.partial = append(append([]byte(nil), p...), r.partial...)
+	} else {
+		r.partial = append(r.partial[:0], p...)
+	}
+	r.settle()
+}
+
+// heldCopy returns a copy of every byte r holds, nil if there are none.
+func (r *BufferReader) heldCopy() []byte {
+	if len(r.back)+len(r.partial) == 0 {
+		return nil
+	}
+	return append(append([]byte(nil), r.back...), r.partial...)
+}
+
+// Read reads the next bytes of the buffer into p, blocking while the buffer is open and has no new data.
+// Non-blocking readers (see SetBlocking) return 0, nil instead of blocking.
+// If the Buffer has a RecordSize, Read only returns whole records (until the final partial record at the end).
+// After a full buffer dropped data r hadn't read (see DropSlowestReader), the next read returns 0, ErrDropped,
+// and after it closed r (see CloseSlowestReader) every read returns 0, ErrSlowReader. The same goes for r's
+// other read methods (ex. WriteTo, Discard, ReadMessage), so the gap is never passed on silently.
+func (r *BufferReader) Read(p []byte) (n int, err error) {
+	if err = r.lost(); err != nil {
+		return 0, err
+	}
+	if r.pastDeadline() && len(r.held()) == 0 && r.data.Len() == 0 {
+		return 0, ErrReadTimeout
+	}
+
+	r.reading = true
+	defer func() { r.reading = false }()
+	if r.timeout > 0 && !r.nonblock && len(r.held()) == 0 && r.data.Len() == 0 { // may block
+		expired := make(chan struct{})
+		t := time.AfterFunc(r.timeout, func() { close(expired) })
+		defer t.Stop()
+		n, err = r.readUntil(p, expired, ErrReadTimeout, r.readNow)
+	} else {
+		n, err = r.readNow(p)
+	}
+	if n == 0 && err == nil && r.pastDeadline() {
+		err = ErrReadTimeout
+	}
+	return n, err
+}
+
+// pastDeadline returns whether the read deadline has passed.
+func (r *BufferReader) pastDeadline() bool { return atomic.LoadInt32(&r.expired) == 1 }
+
+// interrupted returns whether a blocked Read should stop waiting for data.
+func (r *BufferReader) interrupted() bool {
+	return r.isCanceled() || r.reading && r.pastDeadline()
+}
+
+// readNow is Read without the read timeout.
+func (r *BufferReader) readNow(p []byte) (n int, err error) {
+	r.prev = nil
+	if r.record > 0 {
+		return r.readRecords(p)
+	}
+	return r.readBlocking(p, !r.nonblock)
+}
+
+// SetReadTimeout sets how long a Read may block without data before it returns ErrReadTimeout, overriding
+// the Buffer's DefaultReadTimeout. The timeout applies to each Read separately and r is still usable after one
+// times out. A d <= 0 disables it.
+func (r *BufferReader) SetReadTimeout(d time.Duration) {
+	r.timeout = d
+}
+
+// SetReadDeadline sets the time after which a Read blocked waiting for data returns ErrReadTimeout, like
+// net.Conn's SetReadDeadline. Unlike the read timeout it's shared by all following Reads, and it's safe to call
+// while a Read is blocked (ex. to interrupt it). A Read started after the deadline has passed fails right away
+// unless r already holds unread data. r is still usable after a timeout and a new deadline, a zero t removes
+// the deadline. It always returns nil.
+func (r *BufferReader) SetReadDeadline(t time.Time) error {
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.stopDeadline()
+	if t.IsZero() {
+		return nil
+	}
+
+	if d := time.Until(t); d <= 0 {
+		r.expire()
+	} else {
+		gen := r.dgen
+		r.dtimer = time.AfterFunc(d, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if r.dgen == gen { // the deadline wasn't changed since
+				r.expire()
+			}
+		})
+	}
+	return nil
+}
+
+// expire marks the read deadline as passed and wakes a blocked Read. b.mu must be held.
+func (r *BufferReader) expire() {
+	atomic.StoreInt32(&r.expired, 1)
+	r.buf.rwait.Broadcast()
+}
+
+// stopDeadline removes the read deadline. b.mu must be held.
+func (r *BufferReader) stopDeadline() {
+	if r.dtimer != nil {
+		r.dtimer.Stop()
+		r.dtimer = nil
+	}
+	r.dgen++
+	atomic.StoreInt32(&r.expired, 0)
+}
+
+// SetReadAhead limits the bytes r takes from the buffer at once to n, a n <= 0 removes the limit.
+// Taken bytes count as read for eviction, but are still read by r even if it's advanced by SetMaxLag or
+// SetMaxReaderAge, and may keep the old memory of a reallocated buffer alive until they are. A small
+// limit bounds that, at the cost of locking the buffer more often to take more bytes.
+func (r *BufferReader) SetReadAhead(n int) {
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.ahead = n
+	if l := r.data.Len(); n > 0 && l > n {
+		r.data = limit(r.data, n)
+		r.size -= l - n
+		r.settle()
+	}
+}
+
+// Protect stops SetMaxLag and SetMaxReaderAge from advancing r until Unprotect is called, so it doesn't skip
+// data during a critical section. A protected reader holds data in the buffer like any other reader, so the
+// buffer may grow past the max lag while it's protected.
+func (r *BufferReader) Protect() {
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.protected = true
+}
+
+// Unprotect undoes Protect, r is advanced right away if it's behind the max lag.
+func (r *BufferReader) Unprotect() {
+	b := r.buf
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.protected = false
+	if r.alive() {
+		b.enforceMaxLag()
+	}
+}
+
+// ReadWithCancel is like Read, but if it's blocked waiting for data when cancel is closed it
+// returns ErrReadCanceled instead.
+func (r *BufferReader) ReadWithCancel(p []byte, cancel <-chan struct{}) (n int, err error) {
+	return r.readUntil(p, cancel, ErrReadCanceled, r.Read)
+}
+
+// ReadContext is like Read, but if it's blocked waiting for data when ctx is done it returns ctx.Err() instead.
+// Other readers blocked on the buffer keep waiting.
+func (r *BufferReader) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	if n, err = r.readUntil(p, ctx.Done(), ErrReadCanceled, r.Read); err == ErrReadCanceled {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+// readUntil reads with read, returning cerr instead if it's blocked waiting for data when cancel is closed.
+func (r *BufferReader) readUntil(p []byte, cancel <-chan struct{}, cerr error, read readFunc) (n int, err error) {
+	select {
+	case <-cancel:
+		return 0, cerr
+	default:
+	}
+
+	// fired is this call's own, so when calls nest (ex. ReadWithCancel and the read timeout) each one
+	// reports its own error, r.canceled only tells read to stop waiting.
+	var fired bool
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-cancel:
+			b := r.buf
+			b.mu.Lock()
+			fired = true
+			atomic.AddInt32(&r.canceled, 1)
+			b.rwait.Broadcast()
+			b.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	n, err = read(p)
+	close(stop)
+	<-done
+	if fired {
+		atomic.AddInt32(&r.canceled, -1)
+		if n == 0 && err == nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+func (r *BufferReader) isCanceled() bool { return atomic.LoadInt32(&r.canceled) > 0 }
+
+// SetBlocking sets whether Read blocks while the buffer is open and has no new data, readers block
+// by default unless the Buffer was set to NonBlockingReads. Other methods (ex. Discard, ReadMessage) always block.
+func (r *BufferReader) SetBlocking(block bool) {
+	r.nonblock = !block
+}
+
+// readRecords reads as many whole records as fit in p, holding onto any trailing partial record.
+func (r *BufferReader) readRecords(p []byte) (n int, err error) {
+	if len(p) < r.record {
+		return 0, io.ErrShortBuffer
+	}
+	p = p[:len(p)-len(p)%r.record]
+
+	var m int
+	for n < r.record && err == nil {
+		m, err = r.readBlocking(p[n:], !r.nonblock)
+		if n += m; m == 0 && (r.nonblock || r.interrupted()) {
+			break
+		}
+	}
+
+	if tail := n % r.record; err == nil && tail > 0 {
+		r.unhold(p[n-tail : n])
+		n -= tail
+	}
+	return n, err
+}
+
+// readFunc adapts a read method to an io.Reader.
+type readFunc func([]byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) { return f(p) }
+
+func (r *BufferReader) read(p []byte) (n int, err error) {
+	if err = r.lost(); err != nil {
+		return 0, err
+	}
+	return r.readBlocking(p, true)
+}
+
+// readBlocking is read, but returns 0, nil instead of blocking if block is false.
+func (r *BufferReader) readBlocking(p []byte, block bool) (n int, err error) {
+	if n = r.readHeld(p); n > 0 {
+		return n, nil
+	}
+	if r.data.Len() == 0 {
+		r.buf.fetch(r, block)
+		if err = r.lost(); err != nil { // before reading past the data r lost
+			return 0, err
+		}
+	}
+	n, err = r.consume(p)
+	if err == io.EOF {
+		if !r.alive() {
+			return n, r.eof()
+		} else if r.buf.alive() {
+			err = nil
+		} else {
+			r.buf.fetch(r, true)
+			if r.data.Len() > 0 {
+				err = nil
+			} else {
+				err = r.eof()
+			}
+		}
+	}
+	return n, err
+}
+
+// ReadByte reads the next byte, blocking for it like Read. It ignores the Buffer's RecordSize.
+func (r *BufferReader) ReadByte() (byte, error) {
+	var p [1]byte
+	for {
+		if n, err := r.read(p[:]); n == 1 {
+			r.prev, r.prevRune = p[:], false
+			return p[0], nil
+		} else if err != nil {
+			r.prev = nil
+			return 0, err
+		}
+	}
+}
+
+// ReadRune reads the next UTF-8 encoded rune and its size in bytes, blocking for it like Read.
+// Invalid encodings are returned as utf8.RuneError with size 1, like bufio.Reader.
+func (r *BufferReader) ReadRune() (c rune, size int, err error) {
+	var p [utf8.UTFMax]byte
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	p[0] = b
+	n := 1
+	for ; b >= utf8.RuneSelf && n < len(p) && !utf8.FullRune(p[:n]); n++ {
+		if p[n], err = r.ReadByte(); err != nil {
+			break
+		}
+	}
+
+	c, size = utf8.DecodeRune(p[:n])
+	if size < n { // push back the bytes which aren't part of the rune
+		r.back = append(append([]byte(nil), p[size:n]...), r.back...)
+		r.settle()
+	}
+	r.prev, r.prevRune = append([]byte(nil), p[:size]...), true
+	return c, size, nil
+}
+
+// UnreadByte unreads the last byte read by ReadByte or ReadRune so it's read again, like bufio.Reader
+// it returns bufio.ErrInvalidUnreadByte if the last read wasn't one of them or it was already unread.
+func (r *BufferReader) UnreadByte() error {
+	if len(r.prev) == 0 {
+		return bufio.ErrInvalidUnreadByte
+	}
+	r.back = append(append([]byte(nil), r.prev[len(r.prev)-1]), r.back...)
+	r.prev = nil
+	r.settle()
+	return nil
+}
+
+// UnreadRune unreads the last rune read by ReadRune so it's read again, like bufio.Reader it returns
+// bufio.ErrInvalidUnreadRune if the last read wasn't ReadRune or it was already unread.
+func (r *BufferReader) UnreadRune() error {
+	if len(r.prev) == 0 || !r.prevRune {
+		return bufio.ErrInvalidUnreadRune
+	}
+	r.back = append(r.prev, r.back...)
+	r.prev = nil
+	r.settle()
+	return nil
+}
+
+// Discard skips the next n bytes as if they were Read, without copying them.
+// Like Read it blocks while the buffer is open and has no more data, it returns the # of bytes skipped
+// and io.EOF if the end of the buffer was reached before n bytes were skipped.
+func (r *BufferReader) Discard(n int) (d int, err error) {
+	if err = r.lost(); err != nil {
+		return 0, err
+	}
+	r.prev = nil
+	for h := r.held(); d < n && len(h) > 0; h = r.held() {
+		m := len(h)
+		if m > n-d {
+			m = n - d
+		}
+		r.dropHeld(m)
+		d += m
+	}
+	for d < n {
+		if r.data.Len() == 0 {
+			if err = r.refill(); err != nil {
+				return d, err
+			}
+		}
+		m, _ := r.skip(n - d)
+		d += m
+	}
+	return d, nil
+}
+
+// Seek implements io.Seeker, it moves r to another byte still held by the buffer so it can be read again
+// (or skipped). Offsets are relative to where r started reading like RelativeTell, so Seek(0, io.SeekStart)
+// rewinds r to its start, and io.SeekEnd is relative to the end of the data written so far. It returns the new
+// offset, or ErrSeekRange without moving r if the target was already evicted, is before r's start or is past
+// the end. Bytes written before the oldest open reader's position may be evicted at any time unless they're
+// kept with Keep, so a reader can only reliably rewind that far. Seeking stops r's integrity check.
+func (r *BufferReader) Seek(offset int64, whence int) (int64, error) {
+	b := r.buf
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !r.alive() {
+		return 0, io.ErrClosedPipe
+	}
+
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = int64(r.start) + offset
+	case io.SeekCurrent:
+		target = int64(r.tell()) + offset
+	case io.SeekEnd:
+		target = int64(b.end()) + offset
+	default:
+		return 0, errWhence
+	}
+	if target < int64(b.off) || target < int64(r.start) || target > int64(b.end()) {
+		return 0, ErrSeekRange
+	}
+
+	r.data.Discard(r.data.Len())
+	r.off, r.size = int(target), 0
+	r.back, r.partial, r.prev = nil, r.partial[:0], nil
+	r.settle()
+	r.rsum = nil
+	heap.Fix(&b.rh, r.i)
+	b.shift()
+	b.unthrottle()
+	return target - int64(r.start), nil
+}
+
+// PeekCopy returns a copy of the next n bytes without advancing the reader. The returned slice is
+// owned by the caller and is safe to retain after later reads and evictions.
+// It blocks until n bytes are available, if fewer bytes are returned the error explains why:
+// io.EOF if the buffer or reader was closed, or bufio.ErrBufferFull without blocking if n is larger than the buffer's cap.
+// Bytes pushed back by UnreadByte or UnreadRune, or held back as a partial record, are included.
+func (r *BufferReader) PeekCopy(n int) (p []byte, err error) {
+	return r.peek(n, true)
+}
+
+// Peek is like PeekCopy, but returns the bytes straight from the buffer's memory when they're contiguous,
+// like bufio.Reader.Peek. The returned slice is only valid until the next read from r, and must not be modified.
+func (r *BufferReader) Peek(n int) (p []byte, err error) {
+	return r.peek(n, false)
+}
+
+// peek returns the next n bytes without advancing the reader, copied unless copied is false and they're
+// in the buffer's contiguous memory. Bytes r holds are always copied.
+func (r *BufferReader) peek(n int, copied bool) (p []byte, err error) {
+	if h := r.heldCopy(); len(h) > 0 {
+		if len(h) >= n {
+			return h[:n], nil
+		}
+		p, err = r.peekBuffer(n-len(h), true)
+		return append(h, p...), err
+	}
+	return r.peekBuffer(n, copied)
+}
+
+// peekBuffer is peek, ignoring the bytes r holds.
+func (r *BufferReader) peekBuffer(n int, copied bool) (p []byte, err error) {
+	b := r.buf
+	defer b.flush()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pos := r.pos()
+	if r.alive() && r.off < pos { // release what r already read from its snapshot, or it counts against the cap
+		r.off, r.size = pos, r.data.Len()
+		heap.Fix(&b.rh, r.i)
+		b.shift()
+		b.unthrottle()
+	}
+	full := b.cap > 0 && n > b.cap // don't wait for more than the buffer can hold
+	for !full && b.end()-pos < n && b.alive() && r.alive() {
+		b.rwait.Wait()
+	}
+
+	data := b.buf.NextReader()
+	data.Discard(pos - b.off)
+	data = limit(data, b.end()-pos)
+	if l := data.Len(); l < n {
+		n, err = l, r.eof()
+		if full {
+			err = bufio.ErrBufferFull
+		}
+	}
+	if w, ok := data.(*writer); ok && !copied {
+		if a, _ := split(w.roff, w.off, w.data); len(a) >= n {
+			return a[:n], err
+		}
+	}
+	p = make([]byte, n)
+	n, _ = data.Read(p)
+	return p[:n], err
+}
+
+// CopyBufferTo writes everything r reads to w until the end of the buffer, like io.CopyBuffer.
+// It writes directly from the buffer's memory when it can, and only uses buf as scratch space when
+// it can't (a buffer is allocated if buf is empty). It returns the # of bytes written and the first
+// error encountered, the buffer ending normally isn't an error.
+func (r *BufferReader) CopyBufferTo(w io.Writer, buf []byte) (n int64, err error) {
+	if err = r.lost(); err != nil {
+		return 0, err
+	}
+	r.prev = nil
+	for h := r.held(); len(h) > 0; h = r.held() {
+		m, err := writeFull(w, h)
+		n += int64(m)
+		r.dropHeld(m)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	for {
+		if r.data.Len() == 0 {
+			if err = r.refill(); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return n, err
+			}
+		}
+
+		var m int
+		if data, ok := r.data.(*writer); ok { // write straight from the ring
+			a, b := split(data.roff, data.off, data.data)
+			if m, err = writeFull(w, a); err == nil {
+				var mb int
+				mb, err = writeFull(w, b)
+				m += mb
+			}
+			r.skip(m)
+		} else {
+			if len(buf) == 0 {
+				buf = make([]byte, 32*1024)
+			}
+			m, _ = r.consume(buf)
+			m, err = writeFull(w, buf[:m])
+		}
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// WriteTo writes everything r reads to w until the end of the buffer, straight from the buffer's memory
+// when it can, so io.Copy(w, r) uses it. It's CopyBufferTo without a scratch buffer, and like it always
+// blocks for more data (ignoring SetBlocking and the read timeout).
+func (r *BufferReader) WriteTo(w io.Writer) (n int64, err error) {
+	return r.CopyBufferTo(w, nil)
+}
+
+// StreamTo is like CopyBufferTo, but if w has a Flush method like http.Flusher it's called after every
+// chunk written, so clients of a streaming HTTP response see data as soon as it's written to the buffer.
+// If writing to w fails (ex. the client disconnected) r is closed so it stops holding data in the buffer,
+// and the write error is returned.
+func (r *BufferReader) StreamTo(w io.Writer) (n int64, err error) {
+	if f, ok := w.(flusher); ok {
+		w = flushWriter{w, f}
+	}
+	if n, err = r.CopyBufferTo(w, nil); err != nil {
+		r.Close()
+	}
+	return n, err
+}
+
+// flusher is implemented by http.Flusher.
+type flusher interface {
+	Flush()
+}
+
+// flushWriter flushes after every write.
+type flushWriter struct {
+	io.Writer
+	f flusher
+}
+
+func (w flushWriter) Write(p []byte) (n int, err error) {
+	if n, err = w.Writer.Write(p); n > 0 {
+		w.f.Flush()
+	}
+	return n, err
+}
+
+// writeFull writes p to w, returning io.ErrShortWrite if w doesn't write all of it.
+func writeFull(w io.Writer, p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if n, err = w.Write(p); err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// Process passes up to max of the next bytes to fn without copying them when it can, and advances r by
+// the # of bytes fn reports it consumed, even if fn also returns an error. The slice passed to fn is
+// only valid until fn returns and must not be modified. Like Read it blocks until at least one byte
+// is available, fn may be passed fewer than max bytes even if more are available (ex. when the ring wraps).
+// It returns the # of bytes consumed and fn's error, or io.EOF if the buffer or reader was closed.
+func (r *BufferReader) Process(max int, fn func(p []byte) (consumed int, err error)) (n int, err error) {
+	if max <= 0 {
+		return 0, nil
+	}
+	if err = r.lost(); err != nil {
+		return 0, err
+	}
+
+	r.prev = nil
+	p := r.held()
+	fromHeld := len(p) > 0
+	if !fromHeld {
+		if r.data.Len() == 0 {
+			if err = r.refill(); err != nil {
+				return 0, err
+			}
+		}
+		if data, ok := r.data.(*writer); ok { // straight from the ring
+			if p, _ = split(data.roff, data.off, data.data); len(p) > data.Len() {
+				p = p[:data.Len()]
+			}
+		} else if p, err = r.PeekCopy(r.data.Len()); err != nil && len(p) == 0 {
+			return 0, err
+		}
+	}
+	if len(p) > max {
+		p = p[:max]
+	}
+
+	n, err = fn(p)
+	if n < 0 {
+		n = 0
+	} else if n > len(p) {
+		n = len(p)
+	}
+	if fromHeld {
+		r.dropHeld(n)
+	} else {
+		r.skip(n)
+	}
+	return n, err
+}
+
+// AppendTo appends up to max bytes to dst (all that are available if max <= 0), growing dst once for
+// the data it can see and copying straight from the buffer's memory rather than through a scratch slice like dst.ReadFrom.
+// Like Read it blocks until at least one byte is available, then appends only what's already available.
+func (r *BufferReader) AppendTo(dst *bytes.Buffer, max int) (n int, err error) {
+	if max <= 0 {
+		max = int(^uint(0) >> 1)
+	}
+	grown := false
+	appendTo := func(p []byte) (int, error) {
+		if !grown {
+			avail := r.data.Len()
+			if h := r.held(); len(h) > 0 {
+				avail = len(h)
+			}
+			if avail > max {
+				avail = max
+			}
+			dst.Grow(avail)
+			grown = true
+		}
+		return dst.Write(p)
+	}
+
+	for n < max {
+		var m int
+		m, err = r.Process(max-n, appendTo)
+		n += m
+		if err != nil {
+			break
+		}
+		if r.data.Len() == 0 && len(r.held()) == 0 {
+			if r.buf.fetch(r, false); r.data.Len() == 0 || r.losing() {
+				break
+			}
+			grown = false // grow again for the new snapshot
+		}
+	}
+	return n, err
+}
+
+// ReadAtLeastOrAvailable reads at least min bytes into p, blocking for them like io.ReadAtLeast,
+// then keeps reading whatever is already available in the buffer up to len(p) without blocking again.
+// It always blocks for at least one byte when len(p) > 0. If fewer than min bytes could be read
+// before io.EOF it returns io.ErrUnexpectedEOF, if min > len(p) it returns io.ErrShortBuffer.
+func (r *BufferReader) ReadAtLeastOrAvailable(p []byte, min int) (n int, err error) {
+	if len(p) < min {
+		return 0, io.ErrShortBuffer
+	} else if len(p) == 0 {
+		return 0, nil
+	} else if min < 1 {
+		min = 1
+	}
+
+	var m int
+	for n < min && err == nil {
+		m, err = r.read(p[n:])
+		n += m
+	}
+
+	for n < len(p) && err == nil { // drain what's available, without blocking
+		if m = r.readHeld(p[n:]); m > 0 {
+			n += m
+			continue
+		}
+		if r.data.Len() == 0 {
+			if r.buf.fetch(r, false); r.data.Len() == 0 || r.losing() { // the next read reports the loss
+				break
+			}
+		}
+		m, _ = r.consume(p[n:])
+		n += m
+	}
+
+	if n >= min {
+		err = nil
+	} else if n > 0 && err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// break calls to read.
+func (r *BufferReader) Close() error {
+	r.closeOnce.Do(func() {
+		r.buf.mu.Lock()
+		r.stopDeadline()
+		r.buf.mu.Unlock()
+		defer func() { // even if verify panics
+			r.kill()
+			r.buf.drop(r)
+			r.doneOnce.Do(r.initDone)
+			close(r.done)
+		}()
+		r.verify()
+	})
+	return nil
+}
+
+// finalReader and limitedReader hold their reader in a field rather than embedding it, so methods like
+// WriteTo or Seek which would bypass their Read aren't promoted onto them.
+type finalReader struct {
+	r *BufferReader
+}
+
+func (f finalReader) Read(p []byte) (int, error) {
+	r := f.r
+	b := r.buf
+	b.mu.Lock()
+	for b.alive() && r.alive() { // wait for the buffer to be closed
+		b.rwait.Wait()
+	}
+	b.mu.Unlock()
+	return r.Read(p)
+}
+
+func (f finalReader) Close() error {
+	return f.r.Close()
+}
+
+// limitedReader stops at an absolute offset rather than after a # of bytes, so a reader the buffer advances
+// (ex. by SetMaxLag) doesn't read past it.
+type limitedReader struct {
+	r       *BufferReader
+	barrier int64
+	next    int64 // absolute offset of the next byte r reads
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	r := l.r
+	r.buf.mu.Lock()
+	if len(r.held()) == 0 && r.data.Len() == 0 { // r reads from the buffer next, which may have advanced it
+		l.next = int64(r.tell())
+	}
+	left := l.barrier - l.next
+	r.buf.mu.Unlock()
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err = r.Read(p)
+	l.next += int64(n)
+	return n, err
+}
+
+func (l *limitedReader) Close() error {
+	return l.r.Close()
+}
@@ -0,0 +1,45 @@
+package bufit
+
+import "sync"
+
+// RotatingBuffer holds a current Buffer which can be swapped out for a fresh one, ex. to start a new
+// "epoch" of a broadcast. Readers of a retired Buffer can still read everything which was written to it.
+type RotatingBuffer struct {
+	mu      sync.Mutex
+	newBuf  func() *Buffer
+	current *Buffer
+}
+
+// NewRotatingBuffer returns a RotatingBuffer which uses newBuf to create its current Buffer,
+// and a fresh Buffer every time it's rotated.
+func NewRotatingBuffer(newBuf func() *Buffer) *RotatingBuffer {
+	return &RotatingBuffer{
+		newBuf:  newBuf,
+		current: newBuf(),
+	}
+}
+
+// Current returns the current Buffer.
+func (rb *RotatingBuffer) Current() *Buffer {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.current
+}
+
+// Rotate swaps in a fresh Buffer as the current one and closes the old one, so its readers
+// read io.EOF after draining it. It returns both the old and new Buffers.
+func (rb *RotatingBuffer) Rotate() (old, next *Buffer) {
+	rb.mu.Lock()
+	old, next = rb.current, rb.newBuf()
+	rb.current = next
+	rb.mu.Unlock()
+	old.Close()
+	return old, next
+}
+
+// NextReader returns a new reader of the current Buffer.
+func (rb *RotatingBuffer) NextReader() *BufferReader {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.current.NextBufferReader()
+}
@@ -0,0 +1,104 @@
+package bufit
+
+// SpillWriter is a Writer for use with NewBuffer which keeps bytes in memory like NewMemoryWriter until
+// it holds more than its memory limit, then moves them to a temporary file (see FileWriter) and keeps writing
+// there. Once the buffer is fully drained the file is removed and it goes back to memory. Readers behave the
+// same wherever the bytes are, and readers of bytes taken from memory keep reading them from memory.
+type SpillWriter struct {
+	mem   *writer
+	file  *FileWriter
+	limit int
+}
+
+// NewSpillWriter returns a new SpillWriter which holds up to memLimit bytes in memory before spilling to
+// a temporary file in the default temp directory.
+func NewSpillWriter(memLimit int) *SpillWriter {
+	return &SpillWriter{mem: newWriter(nil), limit: memLimit}
+}
+
+// Spilled returns whether the bytes are currently stored in a file.
+func (w *SpillWriter) Spilled() bool {
+	return w.file != nil
+}
+
+// Len returns the # of bytes buffered for Readers.
+func (w *SpillWriter) Len() int {
+	if w.file != nil {
+		return w.file.Len()
+	}
+	return w.mem.Len()
+}
+
+// Discard drops up to s buffered bytes, it returns io.EOF if the buffer was fully drained.
+// Draining a spilled buffer removes its file.
+func (w *SpillWriter) Discard(s int) (n int, err error) {
+	if w.file == nil {
+		return w.mem.Discard(s)
+	}
+	if n, err = w.file.Discard(s); w.file.Len() == 0 {
+		if cerr := w.file.Close(); cerr != nil {
+			err = cerr
+		}
+		w.file, w.mem = nil, newWriter(nil)
+	}
+	return n, err
+}
+
+// Truncate drops the last s written bytes, it returns the # of bytes actually dropped.
+func (w *SpillWriter) Truncate(s int) (n int, err error) {
+	if w.file != nil {
+		return w.file.Truncate(s)
+	}
+	return w.mem.Truncate(s)
+}
+
+// Write appends p, spilling everything to a file first if it would take the bytes in memory past the limit.
+func (w *SpillWriter) Write(p []byte) (n int, err error) {
+	if w.file == nil && w.mem.Len()+len(p) > w.limit {
+		if err = w.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if w.file != nil {
+		return w.file.Write(p)
+	}
+	return w.mem.Write(p)
+}
+
+// spill moves the bytes in memory to a new temporary file.
+func (w *SpillWriter) spill() error {
+	f, err := NewTempFileWriter("")
+	if err != nil {
+		return err
+	}
+	if _, err = w.mem.NextReader().(*writer).WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.mem = f, nil // existing snapshots still reference the memory
+	return nil
+}
+
+// NextReader returns a Reader of the bytes currently buffered.
+func (w *SpillWriter) NextReader() Reader {
+	if w.file != nil {
+		return w.file.NextReader()
+	}
+	return w.mem.NextReader()
+}
+
+// Sync commits the written bytes to stable storage if they've been spilled, see Flushable.
+func (w *SpillWriter) Sync() error {
+	if w.file != nil {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// Close removes the file if the bytes have been spilled. The Buffer must not be used afterwards.
+func (w *SpillWriter) Close() error {
+	if w.file != nil {
+		return w.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package bufit
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// rateTick is the minimum time between throughput samples.
+	rateTick = 100 * time.Millisecond
+
+	// rateWindow is the time constant of the throughput moving averages.
+	rateWindow = 5 * time.Second
+)
+
+// rate is an exponentially weighted moving average of bytes per second.
+type rate struct {
+	last  time.Time
+	bytes int
+	bps   float64
+	init  bool
+}
+
+func (r *rate) add(now time.Time, n int) {
+	r.bytes += n
+	r.sample(now)
+}
+
+func (r *rate) sample(now time.Time) {
+	if r.last.IsZero() { // start the first sample
+		r.bytes, r.last = 0, now
+		return
+	}
+
+	elapsed := now.Sub(r.last)
+	if elapsed < rateTick {
+		return
+	}
+
+	current := float64(r.bytes) / elapsed.Seconds()
+	if r.init {
+		alpha := 1 - math.Exp(-elapsed.Seconds()/rateWindow.Seconds())
+		r.bps += alpha * (current - r.bps)
+	} else {
+		r.bps, r.init = current, true
+	}
+	r.bytes, r.last = 0, now
+}
+
+// ThroughputStats returns moving averages of the rate bytes are written to the buffer, and the rate bytes
+// are evicted after being read by all readers, in bytes per second over roughly the last few seconds.
+// A write rate which stays above the read rate means the buffer is growing (or writes are blocking on the cap).
+func (b *Buffer) ThroughputStats() (writeBps, readBps float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.wrate.sample(now)
+	b.rrate.sample(now)
+	return b.wrate.bps, b.rrate.bps
+}
+
+// GrowCount returns the # of times the buffer reallocated its memory because it was too small for a write,
+// which can guide the initial size passed to NewMemoryWriter. It's 0 for Writers not returned by NewMemoryWriter.
+func (b *Buffer) GrowCount() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.grows()
+}
+
+// grows returns GrowCount, b.mu must be held.
+func (b *Buffer) grows() int64 {
+	if w, ok := b.buf.(*writer); ok {
+		return w.grows
+	}
+	return 0
+}
+
+// counted records a reader which was just added to the heap.
+func (b *Buffer) counted() {
+	b.opened++
+	if len(b.rh) > b.peak {
+		b.peak = len(b.rh)
+	}
+}
+
+// ReadersOpened returns the total # of readers which have ever joined the buffer.
+func (b *Buffer) ReadersOpened() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.opened
+}
+
+// PeakReaders returns the most readers the buffer has ever had open at the same time.
+func (b *Buffer) PeakReaders() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
+
+// MaxLag returns how many bytes the slowest reader is behind the end of the buffer right now, which is how
+// much data it pins in memory, or 0 if there are no readers. It's the same as Stats' BytesWritten-SlowestOffset.
+//
+// Note that MaxLag isn't the getter of SetMaxLag: it reports the current lag of the slowest reader, the lag
+// SetMaxLag limits, not the limit itself.
+func (b *Buffer) MaxLag() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.off + b.buf.Len() - b.slowest()
+}
+
+// Stats is a point-in-time summary of a Buffer's counters, see Buffer.Stats.
+type Stats struct {
+	// BytesWritten is the total # of bytes written to the buffer (less any truncated by Truncate).
+	BytesWritten int64
+
+	// BytesDiscarded is the total # of bytes evicted from the buffer, so BytesWritten-BytesDiscarded is its Len.
+	BytesDiscarded int64
+
+	// SlowestOffset is the offset in the stream of the oldest byte still held by a reader, BytesWritten
+	// if there are no readers. BytesWritten-SlowestOffset is how much data the slowest reader pins.
+	SlowestOffset int64
+
+	// BytesRead holds the # of bytes each open reader has read, in no particular order.
+	BytesRead []int64
+
+	// ReadersOpened and PeakReaders are the same as the ReadersOpened and PeakReaders methods.
+	ReadersOpened, PeakReaders int
+
+	// GrowCount is the same as the GrowCount method.
+	GrowCount int64
+}
+
+// Stats returns the buffer's counters, they're maintained as the buffer is used so this is cheap.
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := Stats{
+		BytesWritten:   int64(b.off + b.buf.Len()),
+		BytesDiscarded: int64(b.off),
+		SlowestOffset:  int64(b.slowest()),
+		BytesRead:      make([]int64, len(b.rh)),
+		ReadersOpened:  b.opened,
+		PeakReaders:    b.peak,
+		GrowCount:      b.grows(),
+	}
+	for i, r := range b.rh {
+		s.BytesRead[i] = r.BytesRead()
+	}
+	return s
+}
@@ -0,0 +1,11 @@
+//go:build go1.21
+// +build go1.21
+
+package bufit
+
+import "unsafe"
+
+// stringBytes returns the bytes of s without copying them, they must not be modified.
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
@@ -0,0 +1,9 @@
+//go:build !go1.21
+// +build !go1.21
+
+package bufit
+
+// stringBytes returns the bytes of s, they're copied since the module's Go version predates unsafe.StringData.
+func stringBytes(s string) []byte {
+	return []byte(s)
+}
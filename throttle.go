@@ -0,0 +1,152 @@
+package bufit
+
+import "context"
+
+// throttle limits how many bytes written by a producer may be unread by its reader.
+type throttle struct {
+	max   int
+	spans []span
+}
+
+// throttleKey identifies a throttle by its producer and the reader it's keyed to, nil for the slowest reader.
+type throttleKey struct {
+	id int
+	r  *BufferReader
+}
+
+// span is the range of offsets [start, end) written by a producer.
+type span struct {
+	start, end int
+}
+
+// ThrottleProducer makes writes from producer id (see WriteFrom, Write is producer 0) block while more than
+// maxPending of the bytes it wrote haven't been read by the slowest reader. Other producers aren't affected.
+// A single write may go over maxPending, it only blocks before writing more. A maxPending <= 0 removes the throttle.
+// Only bytes written after ThrottleProducer is called are counted. Use BufferReader.ThrottleProducer to throttle
+// a producer by a specific reader instead.
+func (b *Buffer) ThrottleProducer(id int, maxPending int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.throttle(throttleKey{id: id}, maxPending)
+}
+
+// ThrottleProducer is like Buffer.ThrottleProducer, but makes writes from producer id block while more than
+// maxPending of the bytes it wrote haven't been read by r, regardless of other readers. Like eviction, bytes
+// count as read once r's Read moves past the snapshot holding them. The throttle is removed when r is closed.
+func (r *BufferReader) ThrottleProducer(id int, maxPending int) {
+	b := r.buf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.alive() {
+		b.throttle(throttleKey{id: id, r: r}, maxPending)
+	}
+}
+
+// throttle sets the throttle for key, removing it if maxPending <= 0. b.mu must be held.
+func (b *Buffer) throttle(key throttleKey, maxPending int) {
+	defer b.wwait.Broadcast() // the throttle may have been raised
+	if maxPending <= 0 {
+		delete(b.throttles, key)
+		return
+	}
+	if b.throttles == nil {
+		b.throttles = make(map[throttleKey]*throttle)
+	}
+	if t := b.throttles[key]; t != nil {
+		t.max = maxPending
+	} else {
+		b.throttles[key] = &throttle{max: maxPending}
+	}
+}
+
+// waitForProducer blocks while producer id is throttled, or until the buffer is closed. It returns ctx's
+// error if ctx is done while it's still throttled. b.mu must be held.
+func (b *Buffer) waitForProducer(ctx context.Context, id int) error {
+	if !b.throttled(id) {
+		return nil
+	}
+	if ctx.Done() != nil {
+		defer b.wakeOnDone(ctx)()
+	}
+	for b.alive() && ctx.Err() == nil && b.throttled(id) {
+		b.wwait.Wait()
+	}
+	if ctx.Err() != nil && b.alive() && b.throttled(id) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// throttled returns whether any of producer id's throttles has more than its max pending. b.mu must be held.
+func (b *Buffer) throttled(id int) bool {
+	for key, t := range b.throttles {
+		if key.id != id {
+			continue
+		}
+		off := b.slowest()
+		if key.r != nil {
+			off = key.r.off
+		}
+		if t.pending(off) >= t.max {
+			return true
+		}
+	}
+	return false
+}
+
+// slowest returns the offset of the slowest reader, or the end of the buffer without readers. b.mu must be held.
+func (b *Buffer) slowest() int {
+	if len(b.rh) == 0 {
+		return b.off + b.buf.Len()
+	}
+	return b.rh.Peek().off
+}
+
+// produced records that producer id wrote the bytes [start, end). b.mu must be held.
+func (b *Buffer) produced(id, start, end int) {
+	if start == end {
+		return
+	}
+	for key, t := range b.throttles {
+		if key.id != id {
+			continue
+		}
+		if l := len(t.spans); l > 0 && t.spans[l-1].end == start {
+			t.spans[l-1].end = end
+		} else {
+			t.spans = append(t.spans, span{start: start, end: end})
+		}
+	}
+}
+
+// unthrottle wakes throttled producers after a reader advanced or left. b.mu must be held.
+func (b *Buffer) unthrottle() {
+	if len(b.throttles) > 0 {
+		b.wwait.Broadcast()
+	}
+}
+
+// unthrottleReader removes the throttles keyed to r as it leaves. b.mu must be held.
+func (b *Buffer) unthrottleReader(r *BufferReader) {
+	for key := range b.throttles {
+		if key.r == r {
+			delete(b.throttles, key)
+		}
+	}
+}
+
+// pending returns the # of bytes produced after off, dropping spans which end before it.
+func (t *throttle) pending(off int) (n int) {
+	i := 0
+	for i < len(t.spans) && t.spans[i].end <= off {
+		i++
+	}
+	t.spans = t.spans[i:]
+	for _, s := range t.spans {
+		if s.start < off {
+			s.start = off
+		}
+		n += s.end - s.start
+	}
+	return n
+}
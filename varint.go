@@ -0,0 +1,77 @@
+package bufit
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrMalformedVarint is returned by ReadVarintFrame when the length prefix isn't a valid varint.
+var ErrMalformedVarint = errors.New("bufit: malformed varint length prefix")
+
+// ErrFrameTooLarge is returned by ReadVarintFrame and ReadNetstring when the length prefix is larger than the
+// reader's max frame size, see BufferReader.SetMaxVarintFrame and BufferReader.SetMaxNetstring.
+var ErrFrameTooLarge = errors.New("bufit: frame is larger than the max frame size")
+
+// DefaultMaxVarintFrame is the max frame size ReadVarintFrame accepts unless it's changed by SetMaxVarintFrame.
+const DefaultMaxVarintFrame = 4 << 20
+
+// SetMaxVarintFrame sets the max frame size ReadVarintFrame accepts, so a corrupt or hostile length prefix can't
+// make it allocate an arbitrary amount of memory. n <= 0 resets it to DefaultMaxVarintFrame.
+func (r *BufferReader) SetMaxVarintFrame(n int) {
+	r.maxFrame = n
+}
+
+func (r *BufferReader) maxVarintFrame() uint64 {
+	if r.maxFrame <= 0 {
+		return DefaultMaxVarintFrame
+	}
+	return uint64(r.maxFrame)
+}
+
+// WriteVarintFrame writes p to the buffer as a single write prefixed by its length as an unsigned
+// base-128 varint, the framing used by protobuf streams. It returns the # of bytes of the frame which were written.
+func (b *Buffer) WriteVarintFrame(p []byte) (int, error) {
+	frame := make([]byte, binary.MaxVarintLen64, len(p)+binary.MaxVarintLen64)
+	frame = append(frame[:binary.PutUvarint(frame, uint64(len(p)))], p...)
+	return b.Write(frame)
+}
+
+// ReadVarintFrame reads the next varint length prefixed frame and returns its data, blocking until all of it
+// is available. It returns io.EOF if the buffer ended before the frame started, io.ErrUnexpectedEOF if
+// it ended part way through, ErrMalformedVarint if the length prefix is invalid, or ErrFrameTooLarge if it's
+// larger than the max frame size, in which case the prefix is consumed but the frame's data isn't.
+// Like protobuf, non-minimal encodings of the length (ex. trailing 0x80 bytes) are accepted.
+func (r *BufferReader) ReadVarintFrame() ([]byte, error) {
+	var c [1]byte
+	var size uint64
+	max := r.maxVarintFrame()
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(readFunc(r.read), c[:]); err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if i == binary.MaxVarintLen64-1 && c[0] > 1 {
+			return nil, ErrMalformedVarint // overflows a uint64
+		}
+		size |= uint64(c[0]&0x7f) << (7 * i)
+		if c[0] < 0x80 {
+			break
+		}
+	}
+	if size > max {
+		return nil, ErrFrameTooLarge
+	}
+
+	p := make([]byte, size)
+	if _, err := io.ReadFull(readFunc(r.read), p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
@@ -6,6 +6,7 @@ type writer struct {
 	empty     bool
 	off, roff int
 	data      []byte
+	grows     int64 // # of times grow reallocated data
 }
 
 // NewMemoryWriter returns a new Writer for use with NewBuffer that internally
@@ -49,12 +50,35 @@ func (buf *writer) Cap() int {
 	return cap(buf.data)
 }
 
+// Contiguous returns the size of the largest contiguous writable region in the ring.
+// Write doesn't need a contiguous region, it fills the region after off and wraps
+// to the start of the ring, so this is only a diagnostic for ring fragmentation.
+func (buf *writer) Contiguous() int {
+	if !buf.empty && buf.off == buf.roff { // full
+		return 0
+	} else if buf.off < buf.roff {
+		return buf.roff - buf.off
+	} else if tail := len(buf.data) - buf.off; tail > buf.roff {
+		return tail
+	}
+	return buf.roff
+}
+
 func (buf *writer) grow(s int) *writer {
 	c, l := buf.Cap(), buf.Len()
 	if c-l >= s {
 		return buf
 	}
-	next := newWriter(make([]byte, 0, c*2+s))
+	next := buf.realloc(c*2 + s)
+	next.grows++
+	return next
+}
+
+// realloc returns a copy of buf backed by a new []byte with capacity c, buf's []byte is left
+// untouched for any snapshots which still reference it.
+func (buf *writer) realloc(c int) *writer {
+	next := newWriter(make([]byte, 0, c))
+	next.grows = buf.grows
 	if !buf.empty {
 		a, b := split(buf.roff, buf.off, buf.data)
 		next.Write(a)
@@ -63,18 +87,37 @@ func (buf *writer) grow(s int) *writer {
 	return next
 }
 
-// no bounds check, expected.
+// Discard drops up to s bytes, it returns io.EOF if the buffer was fully drained.
 func (buf *writer) Discard(s int) (n int, err error) {
+	if l := buf.Len(); s > l {
+		s = l
+	}
 	if s > 0 {
 		buf.roff = (buf.roff + s) % cap(buf.data)
 		if buf.roff == buf.off {
 			err = io.EOF
 			buf.empty = true
 		}
+	} else if s < 0 {
+		s = 0
 	}
 	return s, err
 }
 
+// Truncate drops the last s written bytes, it returns the # of bytes actually dropped.
+func (buf *writer) Truncate(s int) (n int, err error) {
+	if l := buf.Len(); s > l {
+		s = l
+	}
+	if s > 0 {
+		buf.off = (buf.off - s + cap(buf.data)) % cap(buf.data)
+		if buf.roff == buf.off {
+			buf.empty = true
+		}
+	}
+	return s, nil
+}
+
 func (buf *writer) Write(p []byte) (n int, err error) {
 	*buf = *buf.grow(len(p))
 	a, b := split(buf.off, buf.roff, buf.data)
@@ -101,6 +144,26 @@ func (buf *writer) Read(p []byte) (n int, err error) {
 	return buf.Discard(n)
 }
 
+// WriteTo writes the unread bytes to w without an intermediate copy.
+func (buf *writer) WriteTo(w io.Writer) (n int64, err error) {
+	if buf.empty {
+		return 0, nil
+	}
+	a, b := split(buf.roff, buf.off, buf.data)
+	for _, p := range [][]byte{a, b} {
+		if len(p) == 0 {
+			continue
+		}
+		m, err := w.Write(p)
+		n += int64(m)
+		buf.Discard(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
 func (buf *writer) ReadAt(p []byte, off int64) (n int, err error) {
 	if buf.empty {
 		return 0, io.EOF